@@ -0,0 +1,335 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdvUni/gafaspot/email"
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// approvalRequest is a message to an approver about reservations which wait for a decision.
+type approvalRequest struct {
+	approver     string
+	reservations []util.Reservation
+}
+
+// approvalDecision is a message to a user about the decision on one of the user's reservations.
+type approvalDecision struct {
+	r        util.Reservation
+	approved bool
+	approver string
+	comment  string
+}
+
+// requiresApproval tells whether reservations for environment envPlainName must be approved
+// before they can start. It is false if the environment does not exist.
+func requiresApproval(tx *sql.Tx, envPlainName string) bool {
+	var required bool
+	err := tx.QueryRow("SELECT requires_approval FROM environments WHERE env_plain_name=?;", envPlainName).Scan(&required)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return required
+}
+
+// getApproverPolicy returns the Vault policy of the users who may approve reservations for
+// environment envPlainName. It is empty if the environment does not exist or does not require
+// approval.
+func getApproverPolicy(tx *sql.Tx, envPlainName string) string {
+	var policy sql.NullString
+	err := tx.QueryRow("SELECT approver_policy FROM environments WHERE (env_plain_name=?) AND (requires_approval=1);", envPlainName).Scan(&policy)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return policy.String
+}
+
+// isApprover checks whether user username may approve reservations for environment
+// envPlainName. This is the case if the user had the environment's approver policy among the
+// groups at the last login.
+func isApprover(tx *sql.Tx, username, envPlainName string) bool {
+	policy := getApproverPolicy(tx, envPlainName)
+	if policy == "" {
+		return false
+	}
+	for _, g := range getUserGroups(tx, username) {
+		if strings.EqualFold(g, policy) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEdit records that the not yet started or active reservation r was changed by actor. If r
+// did not start yet and its environment requires approval, r becomes pending again, as the
+// approval was given for the old time range only.
+func recordEdit(tx *sql.Tx, r util.Reservation, actor, reason string) {
+	if (r.Status != util.StatusUpcoming && r.Status != util.StatusPending) || !requiresApproval(tx, r.EnvPlainName) {
+		recordEvent(tx, r.ID, r.Status, r.Status, actor, reason)
+		return
+	}
+	_, err := tx.Exec("UPDATE reservations SET status=?, approval_requested=NULL WHERE id=?;", util.StatusPending, r.ID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	recordEvent(tx, r.ID, r.Status, util.StatusPending, actor, reason+"; needs approval again")
+}
+
+// approveUnrestrictedReservations approves all pending reservations whose environment does not
+// require approval anymore, e.g. because the option was removed from config file. Call it after
+// table environments is filled.
+func approveUnrestrictedReservations(tx *sql.Tx) {
+	rows, err := tx.Query("SELECT id FROM reservations WHERE (status=?) AND env_plain_name IN (SELECT env_plain_name FROM environments WHERE requires_approval=0);", util.StatusPending)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		err = transition(tx, id, util.StatusUpcoming, actorGafaspot, "environment does not require approval anymore")
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// GetPendingApprovals returns all pending reservations which user username may approve, ordered
+// by their start. Nobody can approve own reservations.
+func GetPendingApprovals(username string) []util.Reservation {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (status=?) AND (username!=?) ORDER BY start, id;", util.StatusPending, username)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	pending := assembleReservations(rows)
+	rows.Close()
+
+	approvable := []util.Reservation{}
+	for _, r := range pending {
+		if isApprover(tx, username, r.EnvPlainName) {
+			approvable = append(approvable, r)
+		}
+	}
+	return approvable
+}
+
+// ApproveReservation approves the pending reservation with the given id, so it gets started at
+// its start time. approver must be allowed to approve reservations for the reservation's
+// environment and must not be its owner. The comment is recorded in the reservation's history
+// and the owner gets informed by mail.
+func ApproveReservation(approver string, id int, comment string) error {
+	return decideReservation(approver, id, comment, true)
+}
+
+// RejectReservation rejects the pending reservation with the given id, which frees its time range.
+// The same rules as for ApproveReservation apply. If the reservation is part of a bundle, the
+// other reservations of the bundle get aborted, as a bundle only starts as a whole.
+func RejectReservation(approver string, id int, comment string) error {
+	return decideReservation(approver, id, comment, false)
+}
+
+// decideReservation approves or rejects the pending reservation with the given id.
+func decideReservation(approver string, id int, comment string, approve bool) error {
+	var decision approvalDecision
+	err := func() error {
+		// start a transaction; the scheduler and the waitlist get notified after it is committed
+		defer ServeWaitlists()
+		defer notifyScheduleChanged()
+		tx := beginTransaction()
+		defer commitTransaction(tx)
+
+		rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE id=?;", id)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		reservations := assembleReservations(rows)
+		rows.Close()
+		if len(reservations) == 0 {
+			return ReservationError("reservation does not exist")
+		}
+		r := reservations[0]
+		if r.Status != util.StatusPending {
+			return ReservationError(fmt.Sprintf("reservation is %v; only pending reservations can be approved or rejected", r.Status))
+		}
+		if r.User == approver {
+			return ReservationError("you can not approve or reject your own reservations")
+		}
+		if !isApprover(tx, approver, r.EnvPlainName) {
+			logger.Warningf("user %v tried to decide on reservation with id=%v without being an approver", approver, id)
+			return ReservationError("you are not allowed to approve reservations for this environment")
+		}
+
+		decision = approvalDecision{r: r, approved: approve, approver: approver, comment: comment}
+		if approve {
+			logger.Infof("reservation with id=%v approved by %v", id, approver)
+			return transition(tx, id, util.StatusUpcoming, approver, withComment("approved", comment))
+		}
+		logger.Infof("reservation with id=%v rejected by %v", id, approver)
+		err = transition(tx, id, util.StatusRejected, approver, withComment("rejected", comment))
+		if err != nil {
+			return err
+		}
+		abortBundle(tx, r, approver)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	sendApprovalDecisionMails([]approvalDecision{decision})
+	return nil
+}
+
+// withComment appends an optional comment to the reason of an event.
+func withComment(reason, comment string) string {
+	if comment == "" {
+		return reason
+	}
+	return reason + ": " + comment
+}
+
+// abortBundle aborts the other reservations of r's bundle which did not start yet, after r got
+// rejected. A bundle only starts as a whole, so they can not start without r.
+func abortBundle(tx *sql.Tx, r util.Reservation, actor string) {
+	if r.BundleID == 0 {
+		return
+	}
+	for _, m := range bundleMembers(tx, r, notStartedStatuses) {
+		err := transition(tx, m.ID, util.StatusAborted, actor, fmt.Sprintf("environment %v of the bundle was rejected", r.EnvPlainName))
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// RejectOverduePendingReservations rejects all pending reservations whose start is reached
+// without anybody having approved them. Call it before StartUpcomingReservations, so the other
+// reservations of their bundles get aborted before they start.
+func RejectOverduePendingReservations(now time.Time) {
+	var decisions []approvalDecision
+	func() {
+		tx := beginTransaction()
+		defer commitTransaction(tx)
+
+		for _, r := range getApplicableReservations(tx, now, util.StatusPending, "start") {
+			err := transition(tx, r.ID, util.StatusRejected, actorGafaspot, "not approved before its start")
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			logger.Infof("reservation with id=%v rejected, as it was not approved before its start", r.ID)
+			abortBundle(tx, r, actorGafaspot)
+			decisions = append(decisions, approvalDecision{r: r, approver: actorGafaspot, comment: "nobody approved the reservation before its start"})
+		}
+	}()
+	sendApprovalDecisionMails(decisions)
+}
+
+// ServeApprovalRequests informs the approvers about all pending reservations they were not informed
+// about yet. Each approver who stored a mail address gets one mail listing the reservations to
+// approve. Call it outside of any transaction.
+func ServeApprovalRequests() {
+	var requests []approvalRequest
+	func() {
+		tx := beginTransaction()
+		defer commitTransaction(tx)
+
+		rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (status=?) AND (approval_requested IS NULL) ORDER BY start, id;", util.StatusPending)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		pending := assembleReservations(rows)
+		rows.Close()
+
+		byApprover := map[string]int{}
+		for _, r := range pending {
+			approvers := []string{}
+			if policy := getApproverPolicy(tx, r.EnvPlainName); policy != "" {
+				approvers = getGroupMembers(tx, policy)
+			}
+			for _, approver := range approvers {
+				if approver == r.User {
+					continue
+				}
+				i, ok := byApprover[approver]
+				if !ok {
+					i = len(requests)
+					byApprover[approver] = i
+					requests = append(requests, approvalRequest{approver: approver})
+				}
+				requests[i].reservations = append(requests[i].reservations, r)
+			}
+			_, err = tx.Exec("UPDATE reservations SET approval_requested=? WHERE id=?;", time.Now(), r.ID)
+			if err != nil {
+				logger.Emergency(err)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	if !email.MailingEnabled || len(requests) == 0 {
+		return
+	}
+	envs := GetEnvironments()
+	for _, request := range requests {
+		mailAddress, ok := GetUserEmail(request.approver)
+		if ok {
+			email.SendApprovalRequestMail(mailAddress, request.reservations, envs)
+		}
+	}
+}
+
+// sendApprovalDecisionMails informs users about decisions on their pending reservations, if they
+// stored a mail address. Call it outside of any transaction.
+func sendApprovalDecisionMails(decisions []approvalDecision) {
+	if !email.MailingEnabled || len(decisions) == 0 {
+		return
+	}
+	envs := GetEnvironments()
+	for _, d := range decisions {
+		mailAddress, ok := GetUserEmail(d.r.User)
+		if ok {
+			email.SendApprovalDecisionMail(mailAddress, d.r, envs[d.r.EnvPlainName], d.approved, d.approver, d.comment)
+		}
+	}
+}
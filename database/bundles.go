@@ -0,0 +1,137 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// CreateReservationBundle creates one reservation for each of the environments envPlainNames,
+// all of them with the time range, subject and mail flags of r. The reservations of such a bundle
+// get started and ended together. Each of them gets validated like a single reservation with
+// CreateReservation. Either all reservations get created within one transaction, or none: If any
+// environment is not available, the function returns a ReservationError which names the
+// environment. The created reservations are returned.
+func CreateReservationBundle(r util.Reservation, envPlainNames []string) ([]util.Reservation, error) {
+	envs := map[string]bool{}
+	for _, env := range envPlainNames {
+		envs[env] = true
+	}
+	if len(envs) < 2 {
+		return nil, ReservationError("a bundle needs at least two different environments")
+	}
+	envPlainNames = []string{}
+	for env := range envs {
+		envPlainNames = append(envPlainNames, env)
+	}
+	sort.Strings(envPlainNames)
+
+	err := checkTimes(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	// start a transaction; the scheduler and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+
+	members := []util.Reservation{}
+	for _, env := range envPlainNames {
+		member := r
+		member.EnvPlainName = env
+		err = checkRequirements(tx, member)
+		if err == nil {
+			err = checkConflicts(tx, env, r.Start, r.End, 0)
+		}
+		if err != nil {
+			rollbackTransaction(tx)
+			return nil, ReservationError(fmt.Sprintf("environment %v: %v", env, reasonOf(err)))
+		}
+		members = append(members, member)
+	}
+	// each reservation of the bundle counts against the user's quota
+	err = checkQuota(tx, members)
+	if err != nil {
+		rollbackTransaction(tx)
+		return nil, err
+	}
+
+	res, err := tx.Exec("INSERT INTO reservation_bundles (username, created) VALUES(?,?);", r.User, time.Now())
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	bundleID, err := res.LastInsertId()
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	created := []util.Reservation{}
+	for _, env := range envPlainNames {
+		member := r
+		member.EnvPlainName = env
+		member.BundleID = int(bundleID)
+		member.ID, err = insertReservation(tx, member, fmt.Sprintf("reservation created as part of bundle %v", bundleID))
+		if err != nil {
+			logger.Error(err)
+			rollbackTransaction(tx)
+			return nil, fmt.Errorf("not able to create reservation bundle")
+		}
+		removeFulfilledWaitlistEntries(tx, member)
+		created = append(created, member)
+	}
+	commitTransaction(tx)
+	logger.Infof("created reservation bundle %v for environments %v", bundleID, envPlainNames)
+	return created, nil
+}
+
+// bundleMembers returns all reservations of the bundle which r belongs to and which have one of
+// the given statuses, ordered by environment. If r is not part of a bundle, it returns just r.
+// Functions which change a reservation use it to change all reservations of a bundle alike.
+func bundleMembers(tx *sql.Tx, r util.Reservation, statuses []string) []util.Reservation {
+	if r.BundleID == 0 {
+		return []util.Reservation{r}
+	}
+	args := append([]interface{}{r.User, r.BundleID}, statusArgs(statuses)...)
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (username=?) AND (bundle_id=?) AND (status IN ("+statusPlaceholders(statuses)+")) ORDER BY env_plain_name;", args...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	return assembleReservations(rows)
+}
+
+// bundleError turns the error err, which occurred for the reservation m while changing the
+// reservation r, into an error which names m's environment, if m is another reservation of r's
+// bundle. Otherwise, err is returned unchanged.
+func bundleError(r, m util.Reservation, err error) error {
+	if m.ID == r.ID {
+		return err
+	}
+	return ReservationError(fmt.Sprintf("environment %v of the bundle: %v", m.EnvPlainName, reasonOf(err)))
+}
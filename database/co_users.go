@@ -0,0 +1,170 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// SetCoUsers replaces the co-users of the reservation with the given id by coUsers. Co-users see
+// the reservation in their personal view and get its credentials in the creds view; for
+// environments with SSH, credentials are issued for their own SSH keys. Only the owner can share
+// a reservation, and only as long as it did not start, as the credentials get issued at the
+// start. Every co-user must have logged in to Gafaspot before and, if the environment requires
+// one, must have stored an SSH public key. An empty coUsers stops sharing the reservation.
+// Sharing a reservation which is part of a bundle shares all reservations of the bundle.
+func SetCoUsers(owner string, id int, coUsers []string) error {
+	coUsers = normalizeCoUsers(coUsers)
+
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	r, ok := getUserReservation(tx, owner, id)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to share reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, owner))
+		return ReservationError("reservation does not exist")
+	}
+	if r.Status != util.StatusUpcoming && r.Status != util.StatusPending {
+		return ReservationError(fmt.Sprintf("reservation is %v; only reservations which did not start yet can be shared", r.Status))
+	}
+	for _, coUser := range coUsers {
+		if coUser == owner {
+			return ReservationError("you can not share a reservation with yourself")
+		}
+		if !isKnownUser(tx, coUser) {
+			return ReservationError(fmt.Sprintf("user %v never logged in to Gafaspot", coUser))
+		}
+	}
+
+	members := bundleMembers(tx, r, notStartedStatuses)
+	for _, m := range members {
+		var hasSSH bool
+		if !check(tx, m, &hasSSH) || !hasSSH {
+			continue
+		}
+		for _, coUser := range coUsers {
+			if !UserHasSSH(coUser) {
+				return bundleError(r, m, ReservationError(fmt.Sprintf("user %v has no SSH public key stored, but the environment requires one", coUser)))
+			}
+		}
+	}
+
+	for _, m := range members {
+		if strings.Join(getCoUsers(tx, m.ID), ",") == strings.Join(coUsers, ",") {
+			continue
+		}
+		_, err := tx.Exec("DELETE FROM reservation_co_users WHERE reservation_id=?;", m.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		for _, coUser := range coUsers {
+			_, err = tx.Exec("INSERT INTO reservation_co_users (reservation_id, username) VALUES (?,?);", m.ID, coUser)
+			if err != nil {
+				logger.Emergency(err)
+				os.Exit(1)
+			}
+		}
+		reason := "no longer shared"
+		if len(coUsers) > 0 {
+			reason = "shared with " + strings.Join(coUsers, ", ")
+		}
+		recordEvent(tx, m.ID, m.Status, m.Status, owner, reason)
+		logger.Infof("co-users of reservation with id=%v set to %v", m.ID, coUsers)
+	}
+	return nil
+}
+
+// normalizeCoUsers trims the given usernames, drops empty ones and duplicates and sorts them.
+func normalizeCoUsers(coUsers []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, coUser := range coUsers {
+		coUser = strings.TrimSpace(coUser)
+		if coUser == "" || seen[coUser] {
+			continue
+		}
+		seen[coUser] = true
+		normalized = append(normalized, coUser)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// isKnownUser checks whether user username ever logged in to Gafaspot, as far as the database
+// still remembers.
+func isKnownUser(tx *sql.Tx, username string) bool {
+	var known bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username=?) OR EXISTS (SELECT 1 FROM user_groups WHERE username=?);", username, username).Scan(&known)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return known
+}
+
+// getCoUsers fetches the co-users of the reservation with the given id, ordered by name.
+func getCoUsers(tx *sql.Tx, id int) []string {
+	rows, err := tx.Query("SELECT username FROM reservation_co_users WHERE reservation_id=? ORDER BY username;", id)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	coUsers := []string{}
+	for rows.Next() {
+		var coUser string
+		err = rows.Scan(&coUser)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		coUsers = append(coUsers, coUser)
+	}
+	return coUsers
+}
+
+// fillCoUsers sets the CoUsers of all given reservations.
+func fillCoUsers(tx *sql.Tx, reservations []util.Reservation) {
+	for i := range reservations {
+		reservations[i].CoUsers = getCoUsers(tx, reservations[i].ID)
+	}
+}
+
+// getCoUserKeys fetches the SSH public keys of the co-users of reservation r, mapped to their
+// names. Co-users who removed their key since the reservation was shared are left out, which is
+// recorded in the reservation's history.
+func getCoUserKeys(tx *sql.Tx, r util.Reservation) map[string]string {
+	keys := map[string]string{}
+	for _, coUser := range getCoUsers(tx, r.ID) {
+		key, ok := GetUserSSH(coUser)
+		if !ok {
+			recordEvent(tx, r.ID, r.Status, r.Status, actorGafaspot, fmt.Sprintf("co-user %v gets no credentials, as there is no SSH public key stored for the user", coUser))
+			continue
+		}
+		keys[coUser] = key
+	}
+	return keys
+}
@@ -20,6 +20,7 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"time"
 
@@ -38,10 +39,31 @@ var (
 	maxBookingDays   int
 	maxQueuingMonths int
 
+	// retryMaxAttempts is the number of attempts to start or end a reservation before giving up.
+	retryMaxAttempts int
+	// retryBackoffBase is the time to wait after the first failed attempt. It doubles with each attempt.
+	retryBackoffBase time.Duration
+	// maxParallel limits the number of reservations which are started or ended at the same time.
+	maxParallel int
+
+	// instanceName identifies this Gafaspot instance among all instances sharing the database.
+	instanceName string
+	// instanceStarted is the point in time at which this Gafaspot process initialized the database.
+	// Reservations this instance claimed before were claimed by a previous run of it.
+	instanceStarted time.Time
+
 	db     *sql.DB
 	logger logging.Logger
 )
 
+// maxRetryBackoff limits the time between two attempts of starting or ending a reservation.
+const maxRetryBackoff = 24 * time.Hour
+
+// reservationColumns are the columns of table reservations which are needed to fill a
+// util.Reservation struct. Use it for every SELECT statement whose result is passed to
+// assembleReservations.
+const reservationColumns = "id, status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail, error_detail, attempts, series_id, pool, bundle_id"
+
 // InitDB prepares the database for gafaspot. Opens the database at the path given in config file.
 // As SQLite is used, database doesn't even need to exist yet. Prepares all database tables and
 // fills the environments table with the information from config file.
@@ -54,9 +76,20 @@ func InitDB(l logging.Logger, config util.GafaspotConfig) {
 	ttlMonths = config.DBTTLmonths
 	maxBookingDays = config.MaxBookingDays
 	maxQueuingMonths = config.MaxQueuingMonths
+	retryMaxAttempts = config.RetryMaxAttempts
+	maxParallel = config.MaxParallel
+	quotas = config.Quotas
+	instanceName = config.InstanceName
+	instanceStarted = time.Now()
 
-	// Open database. SQLite databases are simple files, and if database doesn't exist yet, a new file will be created at the specified path
 	var err error
+	retryBackoffBase, err = time.ParseDuration(config.RetryBackoff)
+	if err != nil {
+		logger.Emergencyf("invalid time string in config for retry-backoff: %v", err)
+		os.Exit(1)
+	}
+
+	// Open database. SQLite databases are simple files, and if database doesn't exist yet, a new file will be created at the specified path
 	db, err = sql.Open("sqlite3", config.Database)
 	if err != nil {
 		logger.Emergency("Not able to open database: ", err)
@@ -64,7 +97,89 @@ func InitDB(l logging.Logger, config util.GafaspotConfig) {
 	}
 
 	// Create table reservations. If it already exists, don't overwrite
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservations (id INTEGER PRIMARY KEY, status TEXT NOT NULL, username TEXT NOT NULL, env_plain_name TEXT NOT NULL, start DATETIME NOT NULL, end DATETIME NOT NULL, subject TEXT, labels TEXT, start_mail BOOLEAN NOT NULL DEFAULT 0, end_mail BOOlEAN NOT NULL DEFAULT 0, delete_on DATE NOT NULL);")
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservations (id INTEGER PRIMARY KEY, status TEXT NOT NULL, username TEXT NOT NULL, env_plain_name TEXT NOT NULL, start DATETIME NOT NULL, end DATETIME NOT NULL, subject TEXT, labels TEXT, start_mail BOOLEAN NOT NULL DEFAULT 0, end_mail BOOlEAN NOT NULL DEFAULT 0, delete_on DATE NOT NULL, error_detail TEXT, attempts INTEGER NOT NULL DEFAULT 0, next_retry DATETIME, token_accessor TEXT, series_id INTEGER, pool TEXT, bundle_id INTEGER, approval_requested DATETIME, claimed_by TEXT, claimed_at DATETIME);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	// databases created by older Gafaspot versions may lack some columns in table reservations
+	addColumnIfMissing("reservations", "error_detail", "TEXT")
+	addColumnIfMissing("reservations", "attempts", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("reservations", "next_retry", "DATETIME")
+
+	addColumnIfMissing("reservations", "token_accessor", "TEXT")
+	addColumnIfMissing("reservations", "series_id", "INTEGER")
+	addColumnIfMissing("reservations", "pool", "TEXT")
+	addColumnIfMissing("reservations", "bundle_id", "INTEGER")
+	addColumnIfMissing("reservations", "approval_requested", "DATETIME")
+	addColumnIfMissing("reservations", "claimed_by", "TEXT")
+	addColumnIfMissing("reservations", "claimed_at", "DATETIME")
+
+	// Create table reservation_series. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservation_series (id INTEGER PRIMARY KEY, username TEXT NOT NULL, env_plain_name TEXT NOT NULL, rule TEXT NOT NULL, created DATETIME NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table reservation_bundles. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservation_bundles (id INTEGER PRIMARY KEY, username TEXT NOT NULL, created DATETIME NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table reservation_leases. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservation_leases (reservation_id INTEGER NOT NULL, sec_eng TEXT NOT NULL, lease_id TEXT NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table reservation_co_users. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservation_co_users (reservation_id INTEGER NOT NULL, username TEXT NOT NULL, PRIMARY KEY (reservation_id, username));")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table reservation_events. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reservation_events (id INTEGER PRIMARY KEY, reservation_id INTEGER NOT NULL, time DATETIME NOT NULL, from_status TEXT, to_status TEXT NOT NULL, actor TEXT NOT NULL, reason TEXT);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table hook_results. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS hook_results (id INTEGER PRIMARY KEY, reservation_id INTEGER NOT NULL, stage TEXT NOT NULL, hook TEXT NOT NULL, time DATETIME NOT NULL, success BOOLEAN NOT NULL, output TEXT);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table leader. It holds at most one row: the lease of the Gafaspot instance which scans reservations
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS leader (id INTEGER PRIMARY KEY CHECK (id = 1), holder TEXT NOT NULL, expires DATETIME NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table instance_leases. It holds one row per Gafaspot instance which is alive
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS instance_leases (instance TEXT PRIMARY KEY, expires DATETIME NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table reconciliation_requests. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS reconciliation_requests (time DATETIME NOT NULL, username TEXT NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create table waitlist. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS waitlist (id INTEGER PRIMARY KEY, username TEXT NOT NULL, env_plain_name TEXT NOT NULL, start DATETIME NOT NULL, end DATETIME NOT NULL, subject TEXT, start_mail BOOLEAN NOT NULL DEFAULT 0, end_mail BOOLEAN NOT NULL DEFAULT 0, created DATETIME NOT NULL, notified DATETIME);")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
@@ -77,13 +192,31 @@ func InitDB(l logging.Logger, config util.GafaspotConfig) {
 		os.Exit(1)
 	}
 
-	// Create table environments. If it already exist, delete it first. Someone might have updated the environment configurations before system restart. So this table should be created from scratch.
-	_, err = db.Exec("DROP TABLE IF EXISTS environments;")
+	// Create table user_groups. If it already exists, don't overwrite
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS user_groups (username TEXT NOT NULL, group_name TEXT NOT NULL, delete_on DATE NOT NULL);")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
-	_, err = db.Exec("CREATE TABLE environments (env_plain_name TEXT UNIQUE NOT NULL, env_nice_name TEXT NOT NULL, has_ssh BOOLEAN NOT NULL DEFAULT 0, description TEXT);")
+
+	// Create table maintenance_windows. If it already exists, don't overwrite, as it contains the windows added at runtime
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS maintenance_windows (id INTEGER PRIMARY KEY, env_plain_name TEXT NOT NULL, start DATETIME NOT NULL, end DATETIME NOT NULL, reason TEXT, creator TEXT NOT NULL, from_config BOOLEAN NOT NULL DEFAULT 0);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Create tables environments, pools and pool_members from scratch. Someone might have updated
+	// the environment configurations before system restart. Other Gafaspot instances may use the
+	// database meanwhile, so the tables are rebuilt within one transaction and nobody sees them
+	// empty or missing.
+	tx := beginTransaction()
+	_, err = tx.Exec("DROP TABLE IF EXISTS environments;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	_, err = tx.Exec("CREATE TABLE environments (env_plain_name TEXT UNIQUE NOT NULL, env_nice_name TEXT NOT NULL, has_ssh BOOLEAN NOT NULL DEFAULT 0, description TEXT, waitlist_policy TEXT NOT NULL DEFAULT 'notify', cleanup_buffer INTEGER NOT NULL DEFAULT 0, block_on_hook_failure BOOLEAN NOT NULL DEFAULT 0, requires_approval BOOLEAN NOT NULL DEFAULT 0, approver_policy TEXT);")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
@@ -103,12 +236,118 @@ func InitDB(l logging.Logger, config util.GafaspotConfig) {
 				envHasSSH = true
 			}
 		}
-		_, err = db.Exec("INSERT INTO environments VALUES (?, ?, ?, ?);", envPlainName, envNiceName, envHasSSH, envDescription)
+		envWaitlistPolicy := envConf.WaitlistPolicy
+		if envWaitlistPolicy == "" {
+			envWaitlistPolicy = util.WaitlistPolicyNotify
+		}
+		// the buffer was validated when reading the config; it is stored in seconds
+		var envCleanupBuffer time.Duration
+		if envConf.CleanupBuffer != "" {
+			envCleanupBuffer, _ = time.ParseDuration(envConf.CleanupBuffer)
+		}
+		_, err = tx.Exec("INSERT INTO environments VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", envPlainName, envNiceName, envHasSSH, envDescription, envWaitlistPolicy, int64(envCleanupBuffer.Seconds()), envConf.Hooks.BlockOnFailure, envConf.RequiresApproval, envConf.ApproverPolicy)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+	}
+
+	_, err = tx.Exec("DROP TABLE IF EXISTS pool_members;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	_, err = tx.Exec("DROP TABLE IF EXISTS pools;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	_, err = tx.Exec("CREATE TABLE pools (pool_plain_name TEXT UNIQUE NOT NULL, pool_nice_name TEXT NOT NULL, description TEXT, reassign BOOLEAN NOT NULL DEFAULT 0);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	_, err = tx.Exec("CREATE TABLE pool_members (pool_plain_name TEXT NOT NULL, env_plain_name TEXT NOT NULL);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	// Fill empty tables pools and pool_members with information from configuration file
+	for poolPlainName, poolConf := range config.Pools {
+		poolPlainName = util.CreatePlainIdentifier(poolPlainName)
+		poolNiceName := poolConf.NiceName
+		if poolNiceName == "" {
+			poolNiceName = poolPlainName
+		}
+		_, err = tx.Exec("INSERT INTO pools VALUES (?, ?, ?, ?);", poolPlainName, poolNiceName, poolConf.Description, poolConf.Reassign)
 		if err != nil {
 			logger.Emergency(err)
 			os.Exit(1)
 		}
+		for _, member := range poolConf.Environments {
+			_, err = tx.Exec("INSERT INTO pool_members VALUES (?, ?);", poolPlainName, util.CreatePlainIdentifier(member))
+			if err != nil {
+				logger.Emergency(err)
+				os.Exit(1)
+			}
+		}
 	}
+
+	// Take over the maintenance windows from configuration file
+	notices := syncConfigMaintenanceWindows(tx, config.Environments)
+
+	// Pending reservations do not need approval anymore, if their environment does not require it
+	approveUnrestrictedReservations(tx)
+
+	commitTransaction(tx)
+	sendMaintenanceMails(notices)
+}
+
+// addColumnIfMissing adds a column to an existing database table, if the table does not contain
+// a column with this name yet. This is needed for tables which are created with 'IF NOT EXISTS',
+// as a database from an older Gafaspot version would otherwise never get the new columns.
+// definition is the column's type and constraints as used in a CREATE TABLE statement.
+func addColumnIfMissing(table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notnull, &defaultValue, &pk)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if name == column {
+			return
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	logger.Infof("added column '%s' to database table '%s'", column, table)
+}
+
+// CloseDB closes the database. Call it at shutdown, after all other routines which access the
+// database have stopped.
+func CloseDB() {
+	err := db.Close()
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Info("database closed")
 }
 
 func beginTransaction() *sql.Tx {
@@ -127,6 +366,15 @@ func commitTransaction(tx *sql.Tx) {
 	}
 }
 
+// rollbackTransaction discards all changes of a transaction. Use it instead of commitTransaction
+// if an operation must be done completely or not at all.
+func rollbackTransaction(tx *sql.Tx) {
+	err := tx.Rollback()
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
 func addTTL(t time.Time) time.Time {
 	return t.AddDate(0, ttlMonths, 0)
 }
@@ -137,8 +385,10 @@ func assembleReservations(rows *sql.Rows) []util.Reservation {
 	reservations := []util.Reservation{}
 	for rows.Next() {
 		r := util.Reservation{}
-		var subject, labels sql.NullString
-		err := rows.Scan(&r.ID, &r.Status, &r.User, &r.EnvPlainName, &r.Start, &r.End, &subject, &labels, &r.SendStartMail, &r.SendEndMail)
+		var subject, labels, errorDetail sql.NullString
+		var seriesID, bundleID sql.NullInt64
+		var pool sql.NullString
+		err := rows.Scan(&r.ID, &r.Status, &r.User, &r.EnvPlainName, &r.Start, &r.End, &subject, &labels, &r.SendStartMail, &r.SendEndMail, &errorDetail, &r.Attempts, &seriesID, &pool, &bundleID)
 		if err != nil {
 			logger.Emergency(err)
 			os.Exit(1)
@@ -149,6 +399,18 @@ func assembleReservations(rows *sql.Rows) []util.Reservation {
 		if labels.Valid {
 			r.Labels = labels.String
 		}
+		if errorDetail.Valid {
+			r.ErrorDetail = errorDetail.String
+		}
+		if seriesID.Valid {
+			r.SeriesID = int(seriesID.Int64)
+		}
+		if pool.Valid {
+			r.Pool = pool.String
+		}
+		if bundleID.Valid {
+			r.BundleID = int(bundleID.Int64)
+		}
 
 		reservations = append(reservations, r)
 	}
@@ -0,0 +1,51 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdvUni/gafaspot/util"
+	"github.com/alexcesaro/log/stdlog"
+)
+
+// initTestDB creates a database in a temporary directory, which gets removed by the returned
+// function. The database path and the limits which must be set in every config are filled in
+// before config is passed to InitDB.
+func initTestDB(t *testing.T, config util.GafaspotConfig) func() {
+	dir, err := ioutil.TempDir("", "gafaspot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Database = filepath.Join(dir, "gafaspot.db")
+	config.DBTTLmonths = 12
+	config.MaxBookingDays = 30
+	config.MaxQueuingMonths = 2
+	config.RetryMaxAttempts = 3
+	config.RetryBackoff = "1m"
+	config.MaxParallel = 2
+	InitDB(stdlog.GetFromFlags(), config)
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
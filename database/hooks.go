@@ -0,0 +1,124 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// actorHook is the actor recorded for the events which describe the results of hooks.
+const actorHook = "hook"
+
+type runHooksFunc func(stage string, r util.Reservation) []util.HookResult
+
+// storeHookResults stores the results of the hooks which ran for reservation r in table
+// hook_results. Each result is recorded as an event as well, so it appears in the reservation's
+// history.
+func storeHookResults(r util.Reservation, results []util.HookResult) {
+	if len(results) == 0 {
+		return
+	}
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	var status string
+	err := tx.QueryRow("SELECT status FROM reservations WHERE id=?;", r.ID).Scan(&status)
+	if err != nil {
+		logger.Errorf("could not store hook results for reservation with id=%v: %v", r.ID, err)
+		return
+	}
+	for _, result := range results {
+		_, err = tx.Exec("INSERT INTO hook_results (reservation_id, stage, hook, time, success, output) VALUES(?,?,?,?,?,?);",
+			r.ID, result.Stage, result.Hook, result.Time, result.Success, result.Output)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		outcome := "succeeded"
+		if !result.Success {
+			outcome = "failed"
+		}
+		reason := fmt.Sprintf("%v hook %v %v", result.Stage, result.Hook, outcome)
+		if result.Output != "" {
+			reason += ": " + result.Output
+		}
+		recordEvent(tx, r.ID, status, status, actorHook, reason)
+	}
+}
+
+// hookProblem describes the failed hook among results. The second return value is false if all
+// hooks succeeded.
+func hookProblem(results []util.HookResult) (string, bool) {
+	for _, result := range results {
+		if !result.Success {
+			return fmt.Sprintf("%v hook %v failed: %v", result.Stage, result.Hook, result.Output), true
+		}
+	}
+	return "", false
+}
+
+// blocksOnHookFailure tells whether a failed hook of environment envPlainName keeps the next
+// reservation from starting.
+func blocksOnHookFailure(tx *sql.Tx, envPlainName string) bool {
+	var block bool
+	err := tx.QueryRow("SELECT block_on_hook_failure FROM environments WHERE env_plain_name=?;", envPlainName).Scan(&block)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return block
+}
+
+// getPendingReset checks whether the environment of reservation r still waits to be reset after a
+// previous reservation. This is the case if the environment blocks on hook failures and the most
+// recent run of its after-end hooks failed. The function returns the previous reservation, whose
+// after-end hooks have to succeed before r may start, and whether there is such a reservation.
+func getPendingReset(tx *sql.Tx, r util.Reservation) (util.Reservation, bool) {
+	if !blocksOnHookFailure(tx, r.EnvPlainName) {
+		return util.Reservation{}, false
+	}
+
+	var previousID int
+	var success bool
+	err := tx.QueryRow("SELECT h.reservation_id, h.success FROM hook_results h JOIN reservations r ON h.reservation_id=r.id WHERE (r.env_plain_name=?) AND (r.id!=?) AND (h.stage=?) ORDER BY h.time DESC, h.id DESC LIMIT 1;",
+		r.EnvPlainName, r.ID, util.HookAfterEnd).Scan(&previousID, &success)
+	if err == sql.ErrNoRows || success {
+		return util.Reservation{}, false
+	}
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE id=?;", previousID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	previous := assembleReservations(rows)
+	if len(previous) == 0 {
+		return util.Reservation{}, false
+	}
+	return previous[0], true
+}
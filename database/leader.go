@@ -0,0 +1,133 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"os"
+	"time"
+)
+
+// AcquireLeadership tries to take or renew the leader lease for the Gafaspot instance called
+// instance. Only the leader scans reservations, so that several instances can share one database
+// without starting or ending a reservation twice. The lease is granted, if there is no lease yet,
+// if the instance already holds it, or if the lease of another instance expired. A granted lease
+// is valid until now + ttl; the leader must renew it before. The function returns, whether the
+// instance holds the lease now.
+// Independently of the leader lease, each call renews the instance lease of the instance, which
+// tells the others that it is still alive. Every instance must call the function regularly.
+func AcquireLeadership(instance string, now time.Time, ttl time.Duration) bool {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO instance_leases (instance, expires) VALUES (?,?);", instance, now.Add(ttl))
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	var holder string
+	var expires time.Time
+	err = tx.QueryRow("SELECT holder, expires FROM leader WHERE id=1;").Scan(&holder, &expires)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	if err == nil && holder != instance && expires.After(now) {
+		// another instance holds a valid lease
+		return false
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO leader (id, holder, expires) VALUES (1,?,?);", instance, now.Add(ttl))
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	if holder != instance {
+		logger.Infof("instance '%v' took over the leader lease from '%v'", instance, holder)
+	}
+	return true
+}
+
+// ReleaseLeadership gives up the leader lease, if the Gafaspot instance called instance holds it.
+// This lets another instance take over right away instead of waiting for the lease to expire. The
+// instance lease is given up as well, so reservations the instance left in a transitional status
+// get repeated right away. Call it only after the instance finished all transitions.
+func ReleaseLeadership(instance string) {
+	_, err := db.Exec("DELETE FROM leader WHERE holder=?;", instance)
+	if err != nil {
+		logger.Error(err)
+	}
+	_, err = db.Exec("DELETE FROM instance_leases WHERE instance=?;", instance)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// claim changes the status of the reservation with the given id to the transitional status to,
+// like changeStatus, and records that this Gafaspot instance performs the transition. As long as
+// this instance is alive, no other instance resets the reservation, even if it takes over the
+// leader lease meanwhile.
+func claim(tx *sql.Tx, id int, to, actor, reason string) error {
+	err := changeStatus(tx, id, to, actor, reason)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE reservations SET claimed_by=?, claimed_at=? WHERE id=?;", instanceName, time.Now(), id)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// holdsClaim checks whether the reservation with the given id is still in the transitional
+// status, into which this Gafaspot instance claimed it. This is not the case anymore, if another
+// instance considered this one dead and reset the reservation, e.g. because this process was
+// paused for longer than the lease duration. Then, the other instance is responsible for the
+// reservation, and this instance must not record any outcome for it.
+func holdsClaim(tx *sql.Tx, id int, status string) bool {
+	var current string
+	var claimedBy sql.NullString
+	err := tx.QueryRow("SELECT status, claimed_by FROM reservations WHERE id=?;", id).Scan(&current, &claimedBy)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return current == status && claimedBy.String == instanceName
+}
+
+// CurrentLeader returns the name of the Gafaspot instance which holds a valid leader lease at the
+// point in time now. If there is no such instance, the second return value is false.
+func CurrentLeader(now time.Time) (string, bool) {
+	var holder string
+	var expires time.Time
+	err := db.QueryRow("SELECT holder, expires FROM leader WHERE id=1;").Scan(&holder, &expires)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		logger.Error(err)
+		return "", false
+	}
+	return holder, expires.After(now)
+}
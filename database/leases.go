@@ -0,0 +1,84 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// storeLeases stores the token accessor and lease ids of a freshly started reservation, so they
+// can be revoked explicitly when the reservation ends.
+func storeLeases(tx *sql.Tx, reservationID int, leases util.BookingLeases) {
+	_, err := tx.Exec("UPDATE reservations SET token_accessor=? WHERE id=?;", leases.TokenAccessor, reservationID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	for secEng, leaseIDs := range leases.LeaseIDs {
+		for _, leaseID := range leaseIDs {
+			_, err = tx.Exec("INSERT INTO reservation_leases (reservation_id, sec_eng, lease_id) VALUES (?,?,?);", reservationID, secEng, leaseID)
+			if err != nil {
+				logger.Emergency(err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// getLeases returns the token accessor and lease ids stored for a reservation.
+func getLeases(tx *sql.Tx, reservationID int) util.BookingLeases {
+	leases := util.BookingLeases{LeaseIDs: make(map[string][]string)}
+
+	var accessor sql.NullString
+	err := tx.QueryRow("SELECT token_accessor FROM reservations WHERE id=?;", reservationID).Scan(&accessor)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	leases.TokenAccessor = accessor.String
+
+	rows, err := tx.Query("SELECT sec_eng, lease_id FROM reservation_leases WHERE reservation_id=?;", reservationID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var secEng, leaseID string
+		err = rows.Scan(&secEng, &leaseID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		leases.LeaseIDs[secEng] = append(leases.LeaseIDs[secEng], leaseID)
+	}
+	return leases
+}
+
+// deleteLeases deletes the lease ids stored for a reservation, after they were revoked. The token
+// accessor stays with the reservation, so Vault's audit log can still be tied back to it.
+func deleteLeases(tx *sql.Tx, reservationID int) {
+	_, err := tx.Exec("DELETE FROM reservation_leases WHERE reservation_id=?;", reservationID)
+	if err != nil {
+		logger.Errorf("did not delete reservation leases due to following error: %v\n", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// actorGafaspot is the actor recorded for all transitions which Gafaspot performs on its own,
+// as opposed to transitions caused by a user.
+const actorGafaspot = "gafaspot"
+
+// allowedTransitions defines the lifecycle of a reservation. For each status, it lists the
+// statuses a reservation may change to. Statuses without an entry are terminal.
+//
+//	pending -> upcoming -> starting -> active -> ending -> expired
+//	        -> rejected             -> partial -> ending
+//
+// A failed start or end returns from the transitional status to the previous one until
+// Gafaspot gives up retrying, which leads to failed or error. An upcoming reservation which
+// requires approval returns to pending when it gets edited.
+var allowedTransitions = map[string][]string{
+	util.StatusPending:  {util.StatusUpcoming, util.StatusRejected, util.StatusAborted},
+	util.StatusUpcoming: {util.StatusStarting, util.StatusAborted, util.StatusExpired, util.StatusFailed, util.StatusError, util.StatusPending},
+	util.StatusStarting: {util.StatusActive, util.StatusPartial, util.StatusUpcoming, util.StatusFailed, util.StatusError},
+	util.StatusActive:   {util.StatusEnding},
+	util.StatusPartial:  {util.StatusEnding},
+	util.StatusEnding:   {util.StatusExpired, util.StatusActive, util.StatusPartial, util.StatusError},
+}
+
+// blockingStatuses are the statuses of reservations which occupy their environment within
+// their time range. Reservations with other statuses do not cause conflicts for new reservations.
+var blockingStatuses = []string{util.StatusPending, util.StatusUpcoming, util.StatusStarting, util.StatusActive, util.StatusPartial, util.StatusEnding}
+
+// notStartedStatuses are the statuses of reservations which did not start yet, so their users
+// can still edit or abort them.
+var notStartedStatuses = []string{util.StatusPending, util.StatusUpcoming}
+
+// TransitionError is returned if a reservation's status should change in a way the lifecycle
+// does not allow.
+type TransitionError struct {
+	ID   int
+	From string
+	To   string
+}
+
+func (err TransitionError) Error() string {
+	return fmt.Sprintf("reservation with id=%v can not change status from '%v' to '%v'", err.ID, err.From, err.To)
+}
+
+// transitionAllowed tells whether the lifecycle allows a reservation to change from status from
+// to status to.
+func transitionAllowed(from, to string) bool {
+	for _, allowed := range allowedTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminal tells whether a reservation with the given status keeps it forever.
+func isTerminal(status string) bool {
+	_, ok := allowedTransitions[status]
+	return !ok
+}
+
+// transition changes the status of the reservation with the given id to status to, if the
+// lifecycle allows this for the reservation's current status. Otherwise, it returns a
+// TransitionError and leaves the reservation untouched. Each transition gets recorded in
+// table reservation_events, together with the actor who caused it and a reason.
+// tx is the transaction inside which the transition shall be performed.
+func transition(tx *sql.Tx, id int, to, actor, reason string) error {
+	var from string
+	err := tx.QueryRow("SELECT status FROM reservations WHERE id=?;", id).Scan(&from)
+	if err != nil {
+		return fmt.Errorf("not able to read status of reservation with id=%v: %v", id, err)
+	}
+	if !transitionAllowed(from, to) {
+		return TransitionError{id, from, to}
+	}
+
+	_, err = tx.Exec("UPDATE reservations SET status=? WHERE id=?;", to, id)
+	if err != nil {
+		return fmt.Errorf("not able to change status of reservation with id=%v: %v", id, err)
+	}
+	recordEvent(tx, id, from, to, actor, reason)
+	return nil
+}
+
+// recordEvent writes one entry to table reservation_events. from is empty if the event is the
+// creation of the reservation.
+func recordEvent(tx *sql.Tx, id int, from, to, actor, reason string) {
+	var fromStatus sql.NullString
+	if from != "" {
+		fromStatus = sql.NullString{String: from, Valid: true}
+	}
+	_, err := tx.Exec("INSERT INTO reservation_events (reservation_id, time, from_status, to_status, actor, reason) VALUES(?,?,?,?,?,?);",
+		id, time.Now(), fromStatus, to, actor, reason)
+	if err != nil {
+		logger.Errorf("did not record reservation event due to following error: %v", err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/AdvUni/gafaspot/email"
@@ -36,13 +37,104 @@ func (err ReservationError) Error() string {
 	return fmt.Sprintf("reservation is invalid: %v", string(err))
 }
 
+// statusPlaceholders returns a comma separated list of sql placeholders, one for each status.
+// Use it together with statusArgs to build a condition like 'status IN (...)'.
+func statusPlaceholders(statuses []string) string {
+	return strings.TrimSuffix(strings.Repeat("?,", len(statuses)), ",")
+}
+
+// statusArgs converts a list of statuses to arguments for a sql statement.
+func statusArgs(statuses []string) []interface{} {
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+	return args
+}
+
 // CreateReservation puts a new reservation entry to the database. Bevor writing to database,
 // several checks are performed. Function checks time parameters for plausibility, tests, if
-// user has an ssh key uploaded if necessary, and checks for possible conflicts with existing
-// reservations. If everything is fine, reservation will be created. Otherwise, function returns
+// user has an ssh key uploaded if necessary, checks for possible conflicts with existing
+// reservations and whether the user's booking quota allows the reservation. If everything is fine, reservation will be created. Otherwise, function returns
 // a reservation error.
 func CreateReservation(r util.Reservation) error {
+	err := checkTimes(&r)
+	if err != nil {
+		return err
+	}
 
+	// start a transaction; the scheduler and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	err = checkRequirements(tx, r)
+	if err != nil {
+		return err
+	}
+
+	// check the environment's availability within the requested time range
+	err = checkConflicts(tx, r.EnvPlainName, r.Start, r.End, 0)
+	if err != nil {
+		return err
+	}
+
+	// check the user's booking quota
+	err = checkQuota(tx, []util.Reservation{r})
+	if err != nil {
+		return err
+	}
+
+	// finally write reservation into database
+	_, err = insertReservation(tx, r, "reservation created")
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	removeFulfilledWaitlistEntries(tx, r)
+	return nil
+}
+
+// insertReservation writes a new upcoming reservation into the database and records its creation
+// as event with the given reason. If its environment requires approval, the reservation is
+// pending instead. It returns the id of the new reservation. All checks must be done before.
+func insertReservation(tx *sql.Tx, r util.Reservation, reason string) (int, error) {
+	// generate the deletion date of reservation entry in database
+	reservationDeleteDate := addTTL(r.End)
+
+	seriesID := sql.NullInt64{Int64: int64(r.SeriesID), Valid: r.SeriesID != 0}
+	pool := sql.NullString{String: r.Pool, Valid: r.Pool != ""}
+	bundleID := sql.NullInt64{Int64: int64(r.BundleID), Valid: r.BundleID != 0}
+	stmt, err := tx.Prepare("INSERT INTO reservations (status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail, delete_on, series_id, pool, bundle_id) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer stmt.Close()
+	status := util.StatusUpcoming
+	if requiresApproval(tx, r.EnvPlainName) {
+		status = util.StatusPending
+	}
+	res, err := stmt.Exec(status, r.User, r.EnvPlainName, r.Start, r.End, r.Subject, r.Labels, r.SendStartMail, r.SendEndMail, reservationDeleteDate, seriesID, pool, bundleID)
+	if err != nil {
+		return 0, err
+	}
+	logger.Infof("new reservation created: %+v", r)
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	recordEvent(tx, int(id), "", status, r.User, reason)
+
+	return int(id), nil
+}
+
+// checkTimes checks the time parameters of a reservation for plausibility: The reservation must
+// lie in the future, end after its start and must neither be too long nor start too far in the
+// future. A start which is only a few minutes in the past gets set to now.
+func checkTimes(r *util.Reservation) error {
 	// check, whether reservation is in future
 	if !r.Start.After(time.Now()) {
 		// leave small tolerance
@@ -67,11 +159,13 @@ func CreateReservation(r util.Reservation) error {
 	if time.Now().AddDate(0, maxQueuingMonths, 0).Before(r.Start) {
 		return ReservationError(fmt.Sprintf("you are not allowed to do reservations which start more than %v months in the future", maxQueuingMonths))
 	}
+	return nil
+}
 
-	// start a transaction
-	tx := beginTransaction()
-	defer commitTransaction(tx)
-
+// checkRequirements checks, whether the reservation's environment exists, whether the user has
+// stored an ssh key if the environment needs one, and whether Gafaspot is able to send the
+// requested e-mails.
+func checkRequirements(tx *sql.Tx, r util.Reservation) error {
 	// check, whether environment exists and determine, whether the reservation needs an ssh key
 	stmt, err := tx.Prepare("SELECT has_ssh FROM environments WHERE (env_plain_name=?);")
 	if err != nil {
@@ -105,80 +199,388 @@ func CreateReservation(r util.Reservation) error {
 			return ReservationError(fmt.Sprintf("there is no e-mail address stored for user %v, so Gafaspot can't mail him", r.User))
 		}
 	}
+	return nil
+}
+
+// UpdateReservation changes start, end, subject and mail flags of an upcoming or pending
+// reservation in one step, so nobody else can take the reservation's time range meanwhile. Only the user who created
+// the reservation can change it. The reservation with id r.ID must belong to r.User; further
+// fields like the environment are taken from the stored reservation. The changed reservation is
+// validated like a new one, but it does not conflict with its own old time range. If any check
+// fails, the reservation stays unchanged and the function returns a ReservationError.
+// If the reservation is part of a bundle, all reservations of the bundle get changed alike, so
+// they still start and end together. A changed reservation for an environment which requires
+// approval has to be approved again.
+func UpdateReservation(r util.Reservation) error {
+	err := checkTimes(&r)
+	if err != nil {
+		return err
+	}
+
+	// start a transaction; the scheduler, the waitlist and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer ServeWaitlists()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	old, ok := getUserReservation(tx, r.User, r.ID)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to update reservation which does not exist or not belongs to specified user; id '%v', user '%v'", r.ID, r.User))
+		return ReservationError("reservation does not exist")
+	}
+	if old.Status != util.StatusUpcoming && old.Status != util.StatusPending {
+		return ReservationError(fmt.Sprintf("reservation is %v; only upcoming and pending reservations can be edited", old.Status))
+	}
+	r.Labels = old.Labels
+
+	members := bundleMembers(tx, old, notStartedStatuses)
+	changed := []util.Reservation{}
+	for _, m := range members {
+		c := r
+		c.ID = m.ID
+		c.Status = m.Status
+		c.EnvPlainName = m.EnvPlainName
+		err = checkRequirements(tx, c)
+		if err == nil {
+			err = checkConflicts(tx, m.EnvPlainName, r.Start, r.End, m.ID)
+		}
+		if err != nil {
+			return bundleError(old, m, err)
+		}
+		changed = append(changed, c)
+	}
+	err = checkQuota(tx, changed)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		// a changed reservation starts over with its attempts
+		_, err = tx.Exec("UPDATE reservations SET start=?, end=?, subject=?, start_mail=?, end_mail=?, delete_on=?, attempts=0, next_retry=NULL WHERE id=?;",
+			r.Start, r.End, r.Subject, r.SendStartMail, r.SendEndMail, addTTL(r.End), m.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		logger.Infof("reservation with id=%v updated: %+v", m.ID, r)
+		recordEdit(tx, m, r.User, fmt.Sprintf("edited; now from %v until %v", r.Start.Format(util.TimeLayout), r.End.Format(util.TimeLayout)))
+	}
+
+	return nil
+}
 
-	// check the environment's availability within the requested time range:
-	// a conflict occurs iff ((start1 <= end2) && (end1 >= start2))
-	stmt, err = tx.Prepare("SELECT start, end FROM reservations WHERE (env_plain_name=?) AND (start<=?) AND (end>=?);")
+// checkConflicts checks the availability of environment envPlainName within the time range from
+// start to end. Only reservations which still occupy their environment are taken into account;
+// the reservation with id excludeID is ignored, so a reservation does not conflict with itself
+// when it gets changed. Pass 0 if there is no such reservation. After each reservation, the
+// environment stays occupied for its cleanup buffer. Maintenance windows of the environment block
+// it as well. In case of a conflict, the function returns a ReservationError.
+func checkConflicts(tx *sql.Tx, envPlainName string, start, end time.Time, excludeID int) error {
+	// a conflict occurs iff ((start1 <= end2 + buffer) && (end1 + buffer >= start2))
+	stmt, err := tx.Prepare("SELECT start, end FROM reservations WHERE (env_plain_name=?) AND (start<=?) AND (end>=?) AND (id!=?) AND (status IN (" + statusPlaceholders(blockingStatuses) + "));")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
 	defer stmt.Close()
 
+	buffer := getCleanupBuffer(tx, envPlainName)
 	var conflictStart, conflictEnd time.Time
-	err = stmt.QueryRow(r.EnvPlainName, r.End, r.Start).Scan(&conflictStart, &conflictEnd)
+	args := append([]interface{}{envPlainName, end.Add(buffer), start.Add(-buffer), excludeID}, statusArgs(blockingStatuses)...)
+	err = stmt.QueryRow(args...).Scan(&conflictStart, &conflictEnd)
 	// there is a conflict, if answer is NOT empty; means, if there is NO sql.ErrNoRows
 	if err == nil {
+		if buffer > 0 {
+			return ReservationError(fmt.Sprintf("reservation conflicts with an existing reservation from %v to %v; the environment needs %v for cleanup after each reservation", conflictStart.Format(util.TimeLayout), conflictEnd.Format(util.TimeLayout), buffer))
+		}
 		return ReservationError(fmt.Sprintf("reservation conflicts with an existing reservation from %v to %v", conflictStart.Format(util.TimeLayout), conflictEnd.Format(util.TimeLayout)))
 	}
 	if err != sql.ErrNoRows {
 		logger.Error(err)
 	}
+	return checkMaintenance(tx, envPlainName, start, end)
+}
 
-	// generate the deletion date of reservation entry in database
-	reservationDeleteDate := addTTL(r.End)
-
-	// finally write reservation into database
-	stmt, err = tx.Prepare("INSERT INTO reservations (status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail, delete_on) VALUES(?,?,?,?,?,?,?,?,?,?);")
-	if err != nil {
+// getCleanupBuffer returns the time which environment envPlainName needs for cleanup after each
+// reservation. It is zero if the environment does not exist.
+func getCleanupBuffer(tx *sql.Tx, envPlainName string) time.Duration {
+	var seconds int64
+	err := tx.QueryRow("SELECT cleanup_buffer FROM environments WHERE env_plain_name=?;", envPlainName).Scan(&seconds)
+	if err != nil && err != sql.ErrNoRows {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec("upcoming", r.User, r.EnvPlainName, r.Start, r.End, r.Subject, r.Labels, r.SendStartMail, r.SendEndMail, reservationDeleteDate)
-	if err != nil {
-		logger.Error(err)
-	} else {
-		logger.Infof("new reservation created: %+v", r)
-	}
-
-	return nil
+	return time.Duration(seconds) * time.Second
 }
 
-// AbortReservation deletes a reservation entry from database. This is only possible, if the
-// reservation is still upcoming and not active yet. This is because an active reservation
-// has to be ended, whereas an upcoming reservation just can be deleted. Further, a reservation
-// is only abortable by the user who created it.
+// AbortReservation sets the status of a reservation to 'aborted'. This is only possible, if the
+// reservation is still upcoming or pending and not active yet. This is because an active reservation
+// has to be ended, whereas an upcoming reservation just can be dropped. Further, a reservation
+// is only abortable by the user who created it. The aborted reservation stays in database, so
+// it remains visible in the user's reservation history, but does not block its time range anymore.
+// Aborting a reservation which is part of a bundle aborts all reservations of the bundle.
 // Function parameter id is the reservation's database id.
 func AbortReservation(username string, id int) error {
-	// start a transaction
+	// start a transaction; the scheduler and the waitlist get notified after it is committed
+	defer ServeWaitlists()
+	defer notifyScheduleChanged()
 	tx := beginTransaction()
 	defer commitTransaction(tx)
 
 	// fetch reservation from database
-	stmt, err := tx.Prepare("SELECT status FROM reservations WHERE (username=?) AND (id=?);")
+	r, ok := getUserReservation(tx, username, id)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to abort reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
+		return nil
+	}
+
+	// check reservation status (can only abort upcoming reservations)
+	if !transitionAllowed(r.Status, util.StatusAborted) {
+		return fmt.Errorf("reservation is already active or expired, though it is not possible anymore to abort it")
+	}
+
+	for _, m := range bundleMembers(tx, r, notStartedStatuses) {
+		err := transition(tx, m.ID, util.StatusAborted, username, "aborted by user")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getUserReservation fetches the reservation with the given id, if it belongs to the user
+// username. The second return value is false if there is no such reservation.
+func getUserReservation(tx *sql.Tx, username string, id int) (util.Reservation, bool) {
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (username=?) AND (id=?);", username, id)
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
-	defer stmt.Close()
-	status := ""
-	err = stmt.QueryRow(username, id).Scan(&status)
-	if err == sql.ErrNoRows {
-		logger.Warning(fmt.Errorf("tried to abort reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
-		return nil
+	defer rows.Close()
+	reservations := assembleReservations(rows)
+	if len(reservations) == 0 {
+		return util.Reservation{}, false
 	}
+	return reservations[0], true
+}
+
+type extendBookingFunc func(r util.Reservation, sshKey string, coUserKeys map[string]string, leases util.BookingLeases) util.BookingResult
+
+// ExtendReservation moves the end of the reservation with the given id to newEnd. Only upcoming,
+// pending and active reservations can be extended, and only by the user who created them. The extended
+// reservation must not conflict with other reservations and must not exceed the maximum booking
+// duration.
+// For an active reservation, the booking in Vault gets extended as well with the extendBooking
+// function: The orphan vault token and the leases get renewed and SSH certificates get signed
+// anew, also the ones of the reservation's co-users, but passwords are not changed. The new end
+// time is stored in a short transaction before Vault is called, so no other reservation can take
+// the time range meanwhile. If extending the
+// booking fails completely, the old end time gets restored. If it fails only for some Secrets
+// Engines, the reservation keeps its new end and the problem is stored with it, as some
+// credentials may already be valid longer.
+// Extending a reservation which is part of a bundle extends all reservations of the bundle; if
+// one of them can not be extended, none is. Like an edit, extending a reservation which did not
+// start yet requires a new approval, if its environment demands one.
+// The extendBooking function is passed as parameter to preserve the separation of database and
+// vault package.
+func ExtendReservation(username string, id int, newEnd time.Time, extendBooking extendBookingFunc) error {
+	claims, err := claimExtension(username, id, newEnd)
 	if err != nil {
-		logger.Error(err)
+		return err
 	}
+	notifyScheduleChanged()
+	ServeApprovalRequests()
 
-	// check reservation status (can only abort upcoming reservations)
-	if status != "upcoming" {
-		return fmt.Errorf("reservation is already active or expired, though it is not possible anymore to abort it")
+	// extend the bookings in Vault outside of any transaction
+	sshKey, _ := GetUserSSH(username)
+	errs := []string{}
+	for _, c := range claims {
+		if c.r.Status != util.StatusActive {
+			continue
+		}
+		extended := c.r
+		extended.End = newEnd
+		logger.Infof("Extending reservation... %+v", extended)
+		result := extendBooking(extended, sshKey, c.coUserKeys, c.leases)
+
+		err = recordExtension(c.r, newEnd, result)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	// the end time may have been restored
+	notifyScheduleChanged()
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
 	}
+	return nil
+}
 
-	// delete reservation from database
-	deleteReservation(tx, id)
+// claimExtension checks whether the reservation with the given id, and all other reservations of
+// its bundle, can be extended to newEnd and stores the new end time within one short
+// transaction. It returns the reservations as they were before, together with their leases.
+func claimExtension(username string, id int, newEnd time.Time) ([]claimedReservation, error) {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
 
+	r, ok := getUserReservation(tx, username, id)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to extend reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
+		return nil, ReservationError("reservation does not exist")
+	}
+	if r.Status != util.StatusUpcoming && r.Status != util.StatusPending && r.Status != util.StatusActive {
+		return nil, ReservationError(fmt.Sprintf("reservation is %v; only upcoming, pending and active reservations can be extended", r.Status))
+	}
+	if !newEnd.After(r.End) {
+		return nil, ReservationError("new end of reservation must be after its current end")
+	}
+	if r.Start.AddDate(0, 0, maxBookingDays).Before(newEnd) {
+		return nil, ReservationError(fmt.Sprintf("you are only allowed to do reservations with a duration up to %v days", maxBookingDays))
+	}
+	members := bundleMembers(tx, r, append([]string{util.StatusActive}, notStartedStatuses...))
+	extended := []util.Reservation{}
+	for _, m := range members {
+		err := checkConflicts(tx, m.EnvPlainName, m.End, newEnd, m.ID)
+		if err != nil {
+			return nil, bundleError(r, m, err)
+		}
+		e := m
+		e.End = newEnd
+		extended = append(extended, e)
+	}
+	err := checkQuota(tx, extended)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := []claimedReservation{}
+	for _, m := range members {
+		_, err = tx.Exec("UPDATE reservations SET end=?, delete_on=? WHERE id=?;", newEnd, addTTL(newEnd), m.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		recordEdit(tx, m, username, "extended until "+newEnd.Format(util.TimeLayout))
+		logger.Infof("reservation with id=%v extended until %v", m.ID, newEnd.Format(util.TimeLayout))
+		c := claimedReservation{r: m, leases: getLeases(tx, m.ID)}
+		var hasSSH bool
+		if m.Status == util.StatusActive && check(tx, m, &hasSSH) && hasSSH {
+			c.coUserKeys = getCoUserKeys(tx, m)
+		}
+		claims = append(claims, c)
+	}
+	return claims, nil
+}
+
+// recordExtension stores the result of extending the booking of the active reservation r to
+// newEnd in database within a short transaction.
+func recordExtension(r util.Reservation, newEnd time.Time, result util.BookingResult) error {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	if result.Err != nil {
+		// nothing got extended in Vault, so restore the old end, unless the reservation changed meanwhile
+		res, err := tx.Exec("UPDATE reservations SET end=?, delete_on=? WHERE id=? AND status=? AND end=?;", r.End, addTTL(r.End), r.ID, util.StatusActive, newEnd)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			recordEvent(tx, r.ID, r.Status, r.Status, actorGafaspot, "extension reverted: "+result.ErrorDetail())
+		}
+		return fmt.Errorf("not able to extend reservation: %v", result.ErrorDetail())
+	}
+	if !result.Succeeded() {
+		errorDetail := "extension failed for some Secrets Engines: " + result.ErrorDetail()
+		_, err := tx.Exec("UPDATE reservations SET error_detail=? WHERE id=?;", errorDetail, r.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		recordEvent(tx, r.ID, r.Status, r.Status, actorGafaspot, errorDetail)
+		return fmt.Errorf("reservation was extended, but some credentials may still expire at %v: %v", r.End.Format(util.TimeLayout), result.ErrorDetail())
+	}
+	return nil
+}
+
+// ReleaseReservation ends the active reservation with the given id right now, so that the
+// environment is free for others before the reservation's scheduled end. Only the user who
+// created the reservation can release it. Partially started reservations can be released as well.
+// The reservation is claimed for ending and its end time is shortened to now within a short
+// transaction; then the booking gets ended in Vault with the endBooking function, outside of any
+// transaction. The outcome is recorded the same way as for reservations which reach their end,
+// so if ending fails, Gafaspot retries it. The end mail is sent if requested. The after-end hooks
+// of the environment run with the runHooks function, just like at a reservation's regular end.
+// Releasing a reservation which is part of a bundle releases all reservations of the bundle.
+func ReleaseReservation(username string, id int, endBooking endBookingFunc, runHooks runHooksFunc) error {
+	now := time.Now()
+	claims, err := claimRelease(username, id, now)
+	if err != nil {
+		return err
+	}
+	notifyScheduleChanged()
+
+	problems := []string{}
+	for _, c := range claims {
+		result := util.BookingResult{EnvPlainName: c.r.EnvPlainName}
+		if c.envExists {
+			logger.Infof("Releasing reservation... %+v", c.r)
+			result = endBooking(c.r.EnvPlainName, c.leases)
+			if result.Succeeded() {
+				storeHookResults(c.r, runHooks(util.HookAfterEnd, c.r))
+			}
+		}
+
+		outcome := recordEndResult(c.r, now, result)
+		logOutcome(outcome)
+		if outcome.Status == util.StatusExpired {
+			sendEndMail(c.r)
+		} else {
+			problems = append(problems, outcome.Problem)
+		}
+	}
+	// the time range after now is free in any case
+	ServeWaitlists()
+	if len(problems) > 0 {
+		return fmt.Errorf("not able to release reservation, Gafaspot will retry: %v", strings.Join(problems, "; "))
+	}
 	return nil
 }
+
+// claimRelease checks whether the reservation with the given id can be released and claims it,
+// together with the other reservations of its bundle, for ending by setting their status to
+// 'ending' and their end time to now, within one short transaction.
+func claimRelease(username string, id int, now time.Time) ([]claimedReservation, error) {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	r, ok := getUserReservation(tx, username, id)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to release reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
+		return nil, ReservationError("reservation does not exist")
+	}
+	if r.Status != util.StatusActive && r.Status != util.StatusPartial {
+		return nil, ReservationError(fmt.Sprintf("reservation is %v; only active reservations can be released", r.Status))
+	}
+
+	claims := []claimedReservation{}
+	for _, m := range bundleMembers(tx, r, []string{util.StatusActive, util.StatusPartial}) {
+		err := claim(tx, m.ID, util.StatusEnding, username, "released by user")
+		if err != nil {
+			// the reservation keeps its status and gets ended at its end time
+			continue
+		}
+		_, err = tx.Exec("UPDATE reservations SET end=?, delete_on=? WHERE id=?;", now, addTTL(now), m.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		m.End = now
+		claims = append(claims, claimedReservation{r: m, envExists: check(tx, m, new(bool)), leases: getLeases(tx, m.ID)})
+	}
+	if len(claims) == 0 {
+		return nil, fmt.Errorf("not able to release reservation")
+	}
+	return claims, nil
+}
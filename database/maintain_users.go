@@ -137,7 +137,7 @@ func DeleteUserEmail(username string) {
 // DeleteOldUserEntries deletes all users from database table "users", who haven't logged in for a
 // long time ("long time" is defined by constant "yearsTTL"). Old user entries are recognized by
 // their delete_on column. So, this function deletes all user entries, whose delete_on dates are
-// exceeded.
+// exceeded. The same applies to the users' groups in table "user_groups".
 func DeleteOldUserEntries(now time.Time) {
 	stmt, err := db.Prepare("DELETE FROM users WHERE delete_on<=?")
 	if err != nil {
@@ -150,4 +150,9 @@ func DeleteOldUserEntries(now time.Time) {
 	if err != nil {
 		logger.Error(err)
 	}
+
+	_, err = db.Exec("DELETE FROM user_groups WHERE delete_on<=?", now)
+	if err != nil {
+		logger.Error(err)
+	}
 }
@@ -0,0 +1,256 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AdvUni/gafaspot/email"
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// maintenanceColumns are the columns of table maintenance_windows which are needed to fill a
+// util.MaintenanceWindow struct.
+const maintenanceColumns = "id, env_plain_name, start, end, reason, creator, from_config"
+
+// maintenanceNotice is a message to a user about a new maintenance window which overlaps with
+// some of his reservations.
+type maintenanceNotice struct {
+	window       util.MaintenanceWindow
+	reservations []util.Reservation
+}
+
+// syncConfigMaintenanceWindows makes table maintenance_windows contain exactly the maintenance
+// windows from config file, next to the windows which admins added at runtime. Windows which
+// were already known before stay untouched; the owners of reservations affected by a new window
+// get informed: the function returns notices for them, which have to be sent with
+// sendMaintenanceMails after tx is committed. Call it after table environments is filled.
+func syncConfigMaintenanceWindows(tx *sql.Tx, environments map[string]util.EnvironmentConfig) []maintenanceNotice {
+	var notices []maintenanceNotice
+	known := map[string]bool{}
+	for _, w := range getMaintenanceWindows(tx, "from_config=1") {
+		known[maintenanceKey(w)] = false
+	}
+	for envPlainName, envConf := range environments {
+		envPlainName = util.CreatePlainIdentifier(envPlainName)
+		for _, m := range envConf.Maintenance {
+			// the times were validated when reading the config
+			w := util.MaintenanceWindow{EnvPlainName: envPlainName, Reason: m.Reason, Creator: "config", FromConfig: true}
+			w.Start, _ = time.ParseInLocation(util.TimeLayout, m.Start, time.Local)
+			w.End, _ = time.ParseInLocation(util.TimeLayout, m.End, time.Local)
+			if !w.End.After(time.Now()) {
+				continue
+			}
+			if _, ok := known[maintenanceKey(w)]; ok {
+				known[maintenanceKey(w)] = true
+				continue
+			}
+			notices = append(notices, insertMaintenanceWindow(tx, w)...)
+		}
+	}
+	for _, w := range getMaintenanceWindows(tx, "from_config=1") {
+		if stillConfigured, ok := known[maintenanceKey(w)]; ok && !stillConfigured {
+			deleteMaintenanceWindow(tx, w.ID)
+		}
+	}
+	return notices
+}
+
+// maintenanceKey identifies a maintenance window from config file, which does not have an id there.
+func maintenanceKey(w util.MaintenanceWindow) string {
+	return fmt.Sprintf("%v|%v|%v|%v", w.EnvPlainName, w.Start.Unix(), w.End.Unix(), w.Reason)
+}
+
+// AddMaintenanceWindow adds a maintenance window at runtime. w.Creator must be the admin who adds
+// it. From then on, the environment can not be reserved during the window. Existing reservations
+// which overlap with the window stay untouched, but their owners get informed with an event in
+// the reservation's history and by mail. The number of affected reservations is returned.
+func AddMaintenanceWindow(w util.MaintenanceWindow) (int, error) {
+	if !w.Start.Before(w.End) {
+		return 0, ReservationError("maintenance must start before it ends")
+	}
+	if !w.End.After(time.Now()) {
+		return 0, ReservationError("maintenance window is already over")
+	}
+	w.FromConfig = false
+
+	var notices []maintenanceNotice
+	err := func() error {
+		tx := beginTransaction()
+		defer commitTransaction(tx)
+
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM environments WHERE env_plain_name=?);", w.EnvPlainName).Scan(&exists)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if !exists {
+			return ReservationError("environment does not exist")
+		}
+		notices = insertMaintenanceWindow(tx, w)
+		return nil
+	}()
+	if err != nil {
+		return 0, err
+	}
+	sendMaintenanceMails(notices)
+
+	affected := 0
+	for _, n := range notices {
+		affected += len(n.reservations)
+	}
+	logger.Infof("maintenance window for env %v from %v until %v added by %v; %v reservations affected", w.EnvPlainName, w.Start.Format(util.TimeLayout), w.End.Format(util.TimeLayout), w.Creator, affected)
+	return affected, nil
+}
+
+// DeleteMaintenanceWindow deletes a maintenance window which an admin added at runtime. Windows
+// from config file can only be removed there. As the time range becomes free, the waitlist gets
+// served afterwards.
+func DeleteMaintenanceWindow(id int, username string) error {
+	defer ServeWaitlists()
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	windows := getMaintenanceWindows(tx, "id=?", id)
+	if len(windows) == 0 {
+		return ReservationError("maintenance window does not exist")
+	}
+	if windows[0].FromConfig {
+		return ReservationError("maintenance window is defined in config file and can only be removed there")
+	}
+	deleteMaintenanceWindow(tx, id)
+	logger.Infof("maintenance window with id=%v deleted by %v", id, username)
+	return nil
+}
+
+// GetMaintenanceWindows returns all maintenance windows which are not over yet, ordered by start.
+func GetMaintenanceWindows() []util.MaintenanceWindow {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+	return getMaintenanceWindows(tx, "end>?", time.Now())
+}
+
+// checkMaintenance returns a ReservationError, if the time range from start to end overlaps
+// with a maintenance window of the environment.
+func checkMaintenance(tx *sql.Tx, envPlainName string, start, end time.Time) error {
+	// same overlap condition as for conflicts between reservations
+	windows := getMaintenanceWindows(tx, "(env_plain_name=?) AND (start<=?) AND (end>=?)", envPlainName, end, start)
+	if len(windows) == 0 {
+		return nil
+	}
+	w := windows[0]
+	reason := ""
+	if w.Reason != "" {
+		reason = fmt.Sprintf(" (%v)", w.Reason)
+	}
+	return ReservationError(fmt.Sprintf("environment is under maintenance from %v to %v%v", w.Start.Format(util.TimeLayout), w.End.Format(util.TimeLayout), reason))
+}
+
+// insertMaintenanceWindow stores w in table maintenance_windows and records an event for each
+// reservation which overlaps with it. It returns a notice for each affected user.
+func insertMaintenanceWindow(tx *sql.Tx, w util.MaintenanceWindow) []maintenanceNotice {
+	res, err := tx.Exec("INSERT INTO maintenance_windows (env_plain_name, start, end, reason, creator, from_config) VALUES(?,?,?,?,?,?);",
+		w.EnvPlainName, w.Start, w.End, w.Reason, w.Creator, w.FromConfig)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	w.ID = int(id)
+
+	args := append([]interface{}{w.EnvPlainName, w.End, w.Start}, statusArgs(blockingStatuses)...)
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (env_plain_name=?) AND (start<=?) AND (end>=?) AND (status IN ("+statusPlaceholders(blockingStatuses)+")) ORDER BY start;", args...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	affected := assembleReservations(rows)
+	rows.Close()
+
+	notices := []maintenanceNotice{}
+	byUser := map[string]int{}
+	for _, r := range affected {
+		recordEvent(tx, r.ID, r.Status, r.Status, w.Creator, fmt.Sprintf("maintenance scheduled from %v until %v: %v", w.Start.Format(util.TimeLayout), w.End.Format(util.TimeLayout), w.Reason))
+		i, ok := byUser[r.User]
+		if !ok {
+			i = len(notices)
+			byUser[r.User] = i
+			notices = append(notices, maintenanceNotice{window: w})
+		}
+		notices[i].reservations = append(notices[i].reservations, r)
+	}
+	return notices
+}
+
+// deleteMaintenanceWindow deletes the maintenance window with the given id.
+func deleteMaintenanceWindow(tx *sql.Tx, id int) {
+	_, err := tx.Exec("DELETE FROM maintenance_windows WHERE id=?;", id)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+}
+
+// sendMaintenanceMails informs users about new maintenance windows which affect their
+// reservations, if they stored a mail address. Call it outside of any transaction.
+func sendMaintenanceMails(notices []maintenanceNotice) {
+	if !email.MailingEnabled || len(notices) == 0 {
+		return
+	}
+	envs := GetEnvironments()
+	for _, n := range notices {
+		mailAddress, ok := GetUserEmail(n.reservations[0].User)
+		if ok {
+			email.SendMaintenanceMail(mailAddress, n.window, envs[n.window.EnvPlainName], n.reservations)
+		}
+	}
+}
+
+// getMaintenanceWindows fetches all maintenance windows which fulfill the condition, ordered by
+// their start. condition is the WHERE clause of the query and args are its arguments.
+func getMaintenanceWindows(tx *sql.Tx, condition string, args ...interface{}) []util.MaintenanceWindow {
+	rows, err := tx.Query("SELECT "+maintenanceColumns+" FROM maintenance_windows WHERE "+condition+" ORDER BY start, id;", args...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	windows := []util.MaintenanceWindow{}
+	for rows.Next() {
+		var w util.MaintenanceWindow
+		var reason sql.NullString
+		err = rows.Scan(&w.ID, &w.EnvPlainName, &w.Start, &w.End, &reason, &w.Creator, &w.FromConfig)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		w.Reason = reason.String
+		windows = append(windows, w)
+	}
+	return windows
+}
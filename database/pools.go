@@ -0,0 +1,225 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"os"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// GetPools returns all pools from database together with their member environments. A pool
+// counts as having SSH if any of its members has.
+func GetPools() map[string]util.Pool {
+	rows, err := db.Query("SELECT p.pool_plain_name, p.pool_nice_name, p.description, p.reassign, m.env_plain_name, e.has_ssh FROM pools p JOIN pool_members m ON p.pool_plain_name=m.pool_plain_name JOIN environments e ON m.env_plain_name=e.env_plain_name ORDER BY p.pool_plain_name, m.env_plain_name;")
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	poolMap := make(map[string]util.Pool)
+	for rows.Next() {
+		p := util.Pool{}
+		var description sql.NullString
+		var member string
+		var memberHasSSH bool
+		err := rows.Scan(&p.PlainName, &p.NiceName, &description, &p.Reassign, &member, &memberHasSSH)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if description.Valid {
+			p.Description = template.HTML(description.String)
+		}
+
+		if existing, ok := poolMap[p.PlainName]; ok {
+			p = existing
+		}
+		p.Members = append(p.Members, member)
+		p.HasSSH = p.HasSSH || memberHasSSH
+		poolMap[p.PlainName] = p
+	}
+	return poolMap
+}
+
+// CreatePoolReservation creates a reservation for any one environment of a pool. The reservation
+// r is checked like with CreateReservation, but for each member of the pool, until one member is
+// free for the reservation's time range. The reservation gets assigned to this member and is
+// returned with EnvPlainName and ID set. If no member is free, the function returns a
+// ReservationError.
+func CreatePoolReservation(r util.Reservation, poolPlainName string) (util.Reservation, error) {
+	err := checkTimes(&r)
+	if err != nil {
+		return r, err
+	}
+
+	// start a transaction; the scheduler and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	members := getPoolMembers(tx, poolPlainName)
+	if len(members) == 0 {
+		return r, ReservationError(fmt.Sprintf("pool %v does not exist", poolPlainName))
+	}
+	// the quota does not depend on the environment
+	err = checkQuota(tx, []util.Reservation{r})
+	if err != nil {
+		return r, err
+	}
+
+	var lastErr error
+	for _, member := range members {
+		candidate := r
+		candidate.EnvPlainName = member
+		candidate.Pool = poolPlainName
+		err = checkRequirements(tx, candidate)
+		if err == nil {
+			err = checkConflicts(tx, candidate.EnvPlainName, candidate.Start, candidate.End, 0)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		candidate.ID, err = insertReservation(tx, candidate, fmt.Sprintf("reservation created through pool %v", poolPlainName))
+		if err != nil {
+			logger.Error(err)
+			return r, fmt.Errorf("not able to create reservation")
+		}
+		removeFulfilledWaitlistEntries(tx, candidate)
+		return candidate, nil
+	}
+	if len(members) == 1 {
+		return r, lastErr
+	}
+	return r, ReservationError(fmt.Sprintf("none of the environments in pool %v is available for this time range; last problem: %v", poolPlainName, reasonOf(lastErr)))
+}
+
+// ReassignPoolReservations moves upcoming reservations which were booked through a pool to
+// another member of the pool, if their assigned environment became unavailable. This is only
+// done for pools which allow it in config. An environment is unavailable if it was removed from
+// config or from the pool, if its time range is occupied otherwise, or if starting the
+// reservation in it failed before. If no other member is free, the reservation stays where it is.
+// Members which require approval are left out, as the reservation was never approved for them.
+func ReassignPoolReservations() {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (status=?) AND pool IN (SELECT pool_plain_name FROM pools WHERE reassign=1);", util.StatusUpcoming)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	reservations := assembleReservations(rows)
+	rows.Close()
+
+	for _, r := range reservations {
+		members := getPoolMembers(tx, r.Pool)
+		reason := unavailableReason(tx, r, members)
+		if reason == "" {
+			continue
+		}
+
+		reassigned := false
+		for _, member := range members {
+			if member == r.EnvPlainName {
+				continue
+			}
+			candidate := r
+			candidate.EnvPlainName = member
+			if requiresApproval(tx, member) || checkRequirements(tx, candidate) != nil || checkConflicts(tx, member, r.Start, r.End, r.ID) != nil {
+				continue
+			}
+
+			// a start in the new environment gets tried right away
+			_, err = tx.Exec("UPDATE reservations SET env_plain_name=?, attempts=0, next_retry=NULL, error_detail=NULL WHERE id=?;", member, r.ID)
+			if err != nil {
+				logger.Emergency(err)
+				os.Exit(1)
+			}
+			recordEvent(tx, r.ID, util.StatusUpcoming, util.StatusUpcoming, actorGafaspot, fmt.Sprintf("reassigned from %v to %v: %v", r.EnvPlainName, member, reason))
+			logger.Infof("reassigned reservation with id=%v from %v to %v: %v", r.ID, r.EnvPlainName, member, reason)
+			reassigned = true
+			break
+		}
+		if !reassigned {
+			logger.Warningf("reservation with id=%v can not be reassigned, as no other environment of pool %v is free: %v", r.ID, r.Pool, reason)
+		}
+	}
+}
+
+// unavailableReason determines, why the environment assigned to the pool reservation r is not
+// available anymore. It returns an empty string if the environment is available.
+func unavailableReason(tx *sql.Tx, r util.Reservation, members []string) string {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM environments WHERE env_plain_name=?);", r.EnvPlainName).Scan(&exists)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	if !exists {
+		return "environment does not exist anymore"
+	}
+
+	isMember := false
+	for _, member := range members {
+		isMember = isMember || member == r.EnvPlainName
+	}
+	if !isMember {
+		return "environment is not part of the pool anymore"
+	}
+
+	err = checkConflicts(tx, r.EnvPlainName, r.Start, r.End, r.ID)
+	if err != nil {
+		return reasonOf(err)
+	}
+
+	if r.Attempts > 0 {
+		return fmt.Sprintf("starting failed: %v", r.ErrorDetail)
+	}
+	return ""
+}
+
+// getPoolMembers returns the plain names of all environments in a pool, ordered by name.
+func getPoolMembers(tx *sql.Tx, poolPlainName string) []string {
+	rows, err := tx.Query("SELECT env_plain_name FROM pool_members WHERE pool_plain_name=? ORDER BY env_plain_name;", poolPlainName)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var member string
+		err = rows.Scan(&member)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		members = append(members, member)
+	}
+	return members
+}
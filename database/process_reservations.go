@@ -20,6 +20,7 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"time"
 
@@ -27,16 +28,95 @@ import (
 	"github.com/AdvUni/gafaspot/util"
 )
 
-// changeStatus sets the status column of the reservation with the given id to the given status string.
-func changeStatus(tx *sql.Tx, id int, status string) {
-	_, err := tx.Exec("UPDATE reservations SET status=? WHERE id=?;", status, id)
+// changeStatus changes the status of the reservation with the given id along the reservation
+// lifecycle and records the transition with actor and reason. If the lifecycle does not allow
+// the transition, the reservation stays untouched and the error gets logged and returned.
+func changeStatus(tx *sql.Tx, id int, status, actor, reason string) error {
+	err := transition(tx, id, status, actor, reason)
 	if err != nil {
-		logger.Error("did not change status due to following error: %v\n", err)
+		logger.Errorf("did not change status due to following error: %v", err)
 	}
+	return err
 }
 
+// clearRetry resets the retry information and error detail of previous failed attempts for the
+// reservation with the given id. Call it after a transition succeeded.
+func clearRetry(tx *sql.Tx, id int) {
+	_, err := tx.Exec("UPDATE reservations SET attempts=0, next_retry=NULL, error_detail=NULL WHERE id=?;", id)
+	if err != nil {
+		logger.Errorf("did not reset retry information due to following error: %v", err)
+	}
+}
+
+// markFailure changes the status of the reservation with the given id to the given status string
+// and stores an error detail along with it, which explains to the user what went wrong. The error
+// detail is used as reason for the transition as well.
+func markFailure(tx *sql.Tx, id int, status, errorDetail string) {
+	err := changeStatus(tx, id, status, actorGafaspot, errorDetail)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("UPDATE reservations SET next_retry=NULL, error_detail=? WHERE id=?;", errorDetail, id)
+	if err != nil {
+		logger.Errorf("did not store error detail due to following error: %v", err)
+	}
+}
+
+// scheduleRetry records a failed attempt to start or end the reservation r. The reservation
+// returns from its transitional status to status retryStatus, so it will be picked up again by a
+// later scan, but not before the backoff for its number of attempts has passed. The backoff
+// doubles with every attempt.
+// If the reservation has reached the maximum number of attempts, nothing gets scheduled and the
+// function returns false. The caller then has to put the reservation into a terminal state.
+func scheduleRetry(tx *sql.Tx, r util.Reservation, now time.Time, retryStatus, errorDetail string) bool {
+	attempts := r.Attempts + 1
+	if attempts >= retryMaxAttempts {
+		return false
+	}
+	nextRetry := now.Add(retryBackoff(attempts))
+	reason := fmt.Sprintf("attempt %v of %v failed, retry at %v: %v", attempts, retryMaxAttempts, nextRetry.Format(util.TimeLayout), errorDetail)
+	err := changeStatus(tx, r.ID, retryStatus, actorGafaspot, reason)
+	if err != nil {
+		return false
+	}
+	_, err = tx.Exec("UPDATE reservations SET attempts=?, next_retry=?, error_detail=? WHERE id=?;", attempts, nextRetry, errorDetail, r.ID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	logger.Infof("scheduled attempt %v of %v for reservation with id=%v at %v", attempts+1, retryMaxAttempts, r.ID, nextRetry.Format(util.TimeLayout))
+	return true
+}
+
+// retryBackoff calculates how long to wait after the given number of failed attempts before
+// trying again. It doubles the configured base backoff with every attempt, up to maxRetryBackoff.
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffBase
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return backoff
+}
+
+// deleteReservation deletes a reservation together with its recorded events from database.
 func deleteReservation(tx *sql.Tx, reservationID int) {
-	_, err := tx.Exec("DELETE FROM reservations WHERE id=?;", reservationID)
+	_, err := tx.Exec("DELETE FROM reservation_events WHERE reservation_id=?;", reservationID)
+	if err != nil {
+		logger.Errorf("did not delete reservation events due to following error: %v\n", err)
+	}
+	_, err = tx.Exec("DELETE FROM hook_results WHERE reservation_id=?;", reservationID)
+	if err != nil {
+		logger.Errorf("did not delete hook results due to following error: %v\n", err)
+	}
+	deleteLeases(tx, reservationID)
+	_, err = tx.Exec("DELETE FROM reservation_co_users WHERE reservation_id=?;", reservationID)
+	if err != nil {
+		logger.Errorf("did not delete co-users due to following error: %v\n", err)
+	}
+	_, err = tx.Exec("DELETE FROM reservations WHERE id=?;", reservationID)
 	if err != nil {
 		logger.Error("did not delete database entry due to following error: %v\n", err)
 	}
@@ -48,15 +128,17 @@ func deleteReservation(tx *sql.Tx, reservationID int) {
 // return all upcoming reservation, which have a start date lieing in the past. Herefore, the
 // reference time "now" has to be explicitly passed. tx is the transaction, in which the database
 // request should be executed.
+// Reservations which wait for a retry of a failed transition are left out until their next_retry
+// time is reached.
 func getApplicableReservations(tx *sql.Tx, now time.Time, status, timeCol string) []util.Reservation {
-	stmt, err := tx.Prepare("SELECT id, status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail FROM reservations WHERE (status=?) AND (" + timeCol + "<=?);")
+	stmt, err := tx.Prepare("SELECT " + reservationColumns + " FROM reservations WHERE (status=?) AND (" + timeCol + "<=?) AND (next_retry IS NULL OR next_retry<=?);")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(status, now)
+	rows, err := stmt.Query(status, now, now)
 	if err != nil {
 		logger.Error(err)
 	}
@@ -80,129 +162,584 @@ func check(tx *sql.Tx, r util.Reservation, hasSSH *bool) bool {
 	if err == sql.ErrNoRows {
 		return false
 	} else if err != nil {
-		logger.Error(err)
+		// without the environment's information, the reservation must not be started at all
+		logger.Emergency(err)
+		os.Exit(1)
 	}
 	return true
 }
 
-type startBookingFunc func(envPlainName, sshKey string, until time.Time)
-type readCredsFunc func(envPlainName string) map[string]map[string]interface{}
+type startBookingFunc func(r util.Reservation, sshKey string, coUserKeys map[string]string) util.BookingResult
+type readCredsFunc func(envPlainName, coUser string) map[string]map[string]interface{}
+
+// claimedReservation is a reservation which was claimed for starting or ending it, together with
+// the information the transition needs from database. As claiming happens inside a short
+// transaction, the actual work in Vault can be done without holding a transaction open.
+type claimedReservation struct {
+	r util.Reservation
+	// sshKey is the user's public key; only needed for starting reservations with ssh
+	sshKey string
+	// coUserKeys maps the co-users of a shared reservation to their public keys; only needed for
+	// starting and extending reservations with ssh
+	coUserKeys map[string]string
+	// envExists tells whether the reservation's environment is still present in database;
+	// only needed for ending reservations
+	envExists bool
+	// leases are the token accessor and lease ids to revoke; only needed for ending reservations
+	leases util.BookingLeases
+	// pendingReset is the previous reservation of the environment, whose after-end hooks have to
+	// be repeated before the reservation may start; only set if hasPendingReset is true
+	pendingReset    util.Reservation
+	hasPendingReset bool
+	// blockOnHookFailure tells whether a failed before-start hook keeps the reservation from starting
+	blockOnHookFailure bool
+}
 
 // StartUpcomingReservations selects all upcoming reservations from database, wich have a start
 // time smaller than now. It applies the startBooking function to all environments which are
-// affected by those reservations. After, it changes the reservation's status in database.
-// The reason, why the startBooking function is passed as parameter
+// affected by those reservations. After, it changes the reservation's status in database:
+// While starting, the reservation has the transitional status 'starting'.
+// If the booking could be started for all Secrets Engines, the reservation becomes 'active'. If
+// it failed, the reservation becomes 'failed'. If starting failed for some Secrets Engines and
+// the startBooking function could not roll back the others, it becomes 'partial'. In the latter
+// two cases, the errors are stored with the reservation.
+// A failed start is retried by later calls with an exponential backoff. Only after the configured
+// number of attempts, the reservation finally becomes 'failed'.
+// Each reservation is handled on its own, so a problem with one reservation does not keep the
+// others from starting. The function returns one ReservationOutcome per handled reservation.
+// The database is only locked for short transactions: one to claim all due reservations, and one
+// per reservation to record the outcome. Vault is called in between, outside of any transaction,
+// so that creating reservations through the web interface is not blocked meanwhile. The bookings
+// get started concurrently, limited by max-parallel-operations from config. Their outcomes are
+// recorded one after another in the order of the claimed reservations.
+// The reservations of a bundle start together or not at all: If one of them does not start, the
+// bookings of the others get ended again with the endBooking function, and all of them are
+// retried together.
+// Before a booking gets started, the runHooks function runs the before-start hooks of the
+// environment. If the environment blocks on hook failures, a failed hook counts as a failed start,
+// and so does a failed after-end hook of the previous reservation, which gets repeated first.
+// For environments with SSH, the startBooking function issues credentials for the keys of the
+// reservation's co-users as well.
+// The reason, why the startBooking and endBooking functions are passed as parameters
 // here is the ambition to preserve the separation of database and vault package. The time 'now' is
 // passed because an unchanging reference is needed over several function calls to avoid
 // inconsistencies.
-func StartUpcomingReservations(now time.Time, startBooking startBookingFunc, readCreds readCredsFunc) {
+func StartUpcomingReservations(now time.Time, startBooking startBookingFunc, endBooking endBookingFunc, readCreds readCredsFunc, runHooks runHooksFunc) []util.ReservationOutcome {
+	claims, outcomes := claimUpcomingReservations(now)
+
+	// trigger the start of the bookings concurrently
+	results := make([]util.BookingResult, len(claims))
+	resetResults := make([][]util.HookResult, len(claims))
+	hookResults := make([][]util.HookResult, len(claims))
+	util.RunParallel(len(claims), maxParallel, func(i int) {
+		c := claims[i]
+		if c.hasPendingReset {
+			resetResults[i] = runHooks(util.HookAfterEnd, c.pendingReset)
+			if problem, failed := hookProblem(resetResults[i]); failed {
+				results[i] = util.BookingResult{EnvPlainName: c.r.EnvPlainName, Err: fmt.Errorf("environment was not reset after the previous reservation: %v", problem)}
+				return
+			}
+		}
+		hookResults[i] = runHooks(util.HookBeforeStart, c.r)
+		if problem, failed := hookProblem(hookResults[i]); failed && c.blockOnHookFailure {
+			results[i] = util.BookingResult{EnvPlainName: c.r.EnvPlainName, Err: fmt.Errorf("%v", problem)}
+			return
+		}
+		logger.Infof("Starting reservation... %+v", c.r)
+		results[i] = startBooking(c.r, c.sshKey, c.coUserKeys)
+	})
+	undoIncompleteBundles(claims, results, endBooking)
+
+	for i, c := range claims {
+		storeHookResults(c.pendingReset, resetResults[i])
+		storeHookResults(c.r, hookResults[i])
+		outcome := recordStartResult(c.r, now, results[i])
+		logOutcome(outcome)
+		outcomes = append(outcomes, outcome)
+
+		if outcome.Status == util.StatusActive {
+			sendStartMail(c.r, readCreds)
+		}
+	}
+	return outcomes
+}
+
+// claimUpcomingReservations selects all upcoming reservations which are due to start and sets
+// their status to 'starting' within one short transaction. Reservations which can not be started
+// at all get their final status right away; their outcomes are returned together with the
+// claimed reservations. Reservations whose environment still needs cleanup after another
+// reservation are not claimed, but postponed until the cleanup buffer is over.
+func claimUpcomingReservations(now time.Time) ([]claimedReservation, []util.ReservationOutcome) {
 	tx := beginTransaction()
 	defer commitTransaction(tx)
 
-	reservations := getApplicableReservations(tx, now, "upcoming", "start")
+	claims := []claimedReservation{}
+	outcomes := []util.ReservationOutcome{}
+	reservations := getApplicableReservations(tx, now, util.StatusUpcoming, "start")
+
+	// reservations whose environment is not cleaned up yet wait for it, together with their bundle
+	readyTimes := map[int]time.Time{}
+	bundleReadyTimes := map[int]time.Time{}
 	for _, r := range reservations {
+		ready, waiting := environmentReadyTime(tx, r, now)
+		if !waiting || r.End.Before(now) {
+			continue
+		}
+		readyTimes[r.ID] = ready
+		if r.BundleID != 0 && ready.After(bundleReadyTimes[r.BundleID]) {
+			bundleReadyTimes[r.BundleID] = ready
+		}
+	}
 
-		if r.End.Before(now) {
-			// in case the end time of the upcoming booking which never was active is already reached for some reason, don't start the booking, just expire it in database
-			changeStatus(tx, r.ID, "expired")
-			// TODO: Possibly write an email?
-			return
+	// problems of bundle members which could not be claimed, by bundle id, and whether the member
+	// can never start, as it reached a terminal status
+	bundleProblems := map[int]string{}
+	bundleTerminal := map[int]bool{}
+	for _, r := range reservations {
+		ready, waiting := readyTimes[r.ID]
+		if bundleReady, ok := bundleReadyTimes[r.BundleID]; ok && r.BundleID != 0 {
+			ready, waiting = bundleReady, true
+		}
+		if waiting {
+			postponeStart(tx, r, ready)
+			continue
 		}
 
-		// check, if environment in reservation exists and fill in the information has_ssh
-		var hasSSH bool
-		ok := check(tx, r, &hasSSH)
+		c, outcome, ok := claimUpcomingReservation(tx, r, now)
+		if ok {
+			claims = append(claims, c)
+		} else {
+			logOutcome(outcome)
+			outcomes = append(outcomes, outcome)
+			if r.BundleID != 0 && !bundleTerminal[r.BundleID] {
+				bundleProblems[r.BundleID] = fmt.Sprintf("environment %v of the bundle can not be started: %v", r.EnvPlainName, outcome.Problem)
+				bundleTerminal[r.BundleID] = isTerminal(outcome.Status)
+			}
+		}
+	}
+
+	// the other members of such a bundle must not start on their own: if the member can never
+	// start, they fail as well, otherwise they return to upcoming to be started together later
+	startable := []claimedReservation{}
+	for _, c := range claims {
+		problem, ok := bundleProblems[c.r.BundleID]
 		if !ok {
-			logger.Warningf("environment %v does not exist; mark reservation with id=%v for user=%v as error", r.EnvPlainName, r.ID, r.User)
-			changeStatus(tx, r.ID, "error")
-			// TODO: Possibly write an email?
-			return
+			startable = append(startable, c)
+			continue
 		}
+		outcome := util.ReservationOutcome{Reservation: c.r, Action: util.ActionStart}
+		if bundleTerminal[c.r.BundleID] {
+			markFailure(tx, c.r.ID, util.StatusFailed, problem)
+			outcome = outcome.Fail(util.StatusFailed, problem)
+		} else if err := changeStatus(tx, c.r.ID, util.StatusUpcoming, actorGafaspot, problem+"; start of the bundle will be tried again"); err != nil {
+			outcome = outcome.Fail(util.StatusStarting, err.Error())
+		} else {
+			outcome = outcome.Fail(util.StatusUpcoming, problem+"; will retry together with the bundle")
+		}
+		logOutcome(outcome)
+		outcomes = append(outcomes, outcome)
+	}
+	return startable, outcomes
+}
 
-		sshKey := ""
-		if hasSSH {
-			// retrieve ssh key from user table
-			sshKey, ok = GetUserSSH(r.User)
-			if !ok {
-				logger.Warningf("there is no ssh public key stored for user %v, but it is required for booking environment %v. Mark reservation with error",
-					r.User, r.EnvPlainName)
-				changeStatus(tx, r.ID, "error")
-				return
-			}
+// environmentReadyTime checks whether the environment of the upcoming reservation r still needs
+// cleanup after another reservation. This is the case if another reservation ended less than the
+// environment's cleanup buffer ago, or if it still holds the environment, e.g. because ending it
+// takes longer than planned. The function returns the point in time at which the environment is
+// expected to be ready, and whether r has to wait for it.
+func environmentReadyTime(tx *sql.Tx, r util.Reservation, now time.Time) (time.Time, bool) {
+	buffer := getCleanupBuffer(tx, r.EnvPlainName)
+	if buffer == 0 {
+		return now, false
+	}
+
+	// another reservation which still holds the environment is expected to end at its end time
+	holding := []string{util.StatusStarting, util.StatusActive, util.StatusPartial, util.StatusEnding}
+	args := append([]interface{}{r.EnvPlainName, r.ID}, statusArgs(holding)...)
+	var end time.Time
+	err := tx.QueryRow("SELECT end FROM reservations WHERE (env_plain_name=?) AND (id!=?) AND (status IN ("+statusPlaceholders(holding)+")) ORDER BY end DESC LIMIT 1;", args...).Scan(&end)
+	if err == nil {
+		if end.Before(now) {
+			end = now
 		}
+		return end.Add(buffer), true
+	}
+	if err != sql.ErrNoRows {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
 
-		// trigger the start of the booking
-		logger.Infof("Starting reservation... %+v", r)
-		startBooking(r.EnvPlainName, sshKey, r.End)
+	// otherwise, the cleanup starts when ending the last reservation was finished
+	err = tx.QueryRow("SELECT e.time FROM reservation_events e JOIN reservations r ON e.reservation_id=r.id WHERE (r.env_plain_name=?) AND (r.id!=?) AND (e.from_status=?) ORDER BY e.time DESC LIMIT 1;", r.EnvPlainName, r.ID, util.StatusEnding).Scan(&end)
+	if err == sql.ErrNoRows {
+		return now, false
+	}
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	ready := end.Add(buffer)
+	return ready, ready.After(now)
+}
 
-		// change booking status in database
-		changeStatus(tx, r.ID, "active")
+// startPostponedReason is the beginning of the reason of the event which records that the start
+// of a reservation was postponed.
+const startPostponedReason = "start postponed"
 
-		// send email to user, if wished and if mailing is enabled in gafaspot config
-		if r.SendStartMail && email.MailingEnabled {
-			mailAddress, ok := GetUserEmail(r.User)
-			if ok {
-				credsInfo := collectReservationCreds(r, readCreds)
-				email.SendBeginReservationMail(mailAddress, credsInfo)
-			} else {
-				logger.Warningf("tried to send an e-mail to user '%s', but there is not mail address stored for him in database (anymore)", r.User)
-			}
+// postponeStart lets the upcoming reservation r wait until ready, without counting it as a failed
+// attempt to start it. The start may be pushed back on every scan while a previous reservation
+// overruns, so the postponement is recorded in the reservation's history only once.
+func postponeStart(tx *sql.Tx, r util.Reservation, ready time.Time) {
+	_, err := tx.Exec("UPDATE reservations SET next_retry=? WHERE id=?;", ready, r.ID)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	var postponed bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM reservation_events WHERE (reservation_id=?) AND (from_status=?) AND (to_status=?) AND (reason LIKE ?));", r.ID, util.StatusUpcoming, util.StatusUpcoming, startPostponedReason+"%").Scan(&postponed)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	if !postponed {
+		recordEvent(tx, r.ID, r.Status, r.Status, actorGafaspot, fmt.Sprintf("%v until %v, as the environment needs cleanup after the previous reservation", startPostponedReason, ready.Format(util.TimeLayout)))
+	}
+	logger.Infof("start of reservation with id=%v postponed until %v for cleanup of env %v", r.ID, ready.Format(util.TimeLayout), r.EnvPlainName)
+}
+
+// claimUpcomingReservation checks whether the reservation r can be started and claims it by
+// setting its status to 'starting'. If the reservation can not be started, it gets its final
+// status, and the function returns the reservation's outcome and false.
+func claimUpcomingReservation(tx *sql.Tx, r util.Reservation, now time.Time) (claimedReservation, util.ReservationOutcome, bool) {
+	c := claimedReservation{r: r}
+	outcome := util.ReservationOutcome{Reservation: r, Action: util.ActionStart}
+
+	if r.End.Before(now) {
+		// in case the end time of the upcoming booking which never was active is already reached for some reason, don't start the booking, just expire it in database
+		if r.Attempts > 0 {
+			// the reservation never became active because all attempts to start it failed
+			markFailure(tx, r.ID, util.StatusFailed, r.ErrorDetail)
+			return c, outcome.Fail(util.StatusFailed, "end time reached before reservation could be started: "+r.ErrorDetail), false
+		}
+		problem := "end time reached before reservation was started"
+		changeStatus(tx, r.ID, util.StatusExpired, actorGafaspot, problem)
+		// TODO: Possibly write an email?
+		return c, outcome.Fail(util.StatusExpired, problem), false
+	}
+
+	// check, if environment in reservation exists and fill in the information has_ssh
+	var hasSSH bool
+	ok := check(tx, r, &hasSSH)
+	if !ok {
+		problem := fmt.Sprintf("environment %v does not exist", r.EnvPlainName)
+		markFailure(tx, r.ID, util.StatusError, problem)
+		// TODO: Possibly write an email?
+		return c, outcome.Fail(util.StatusError, problem), false
+	}
+
+	if hasSSH {
+		// retrieve ssh key from user table
+		c.sshKey, ok = GetUserSSH(r.User)
+		if !ok {
+			problem := fmt.Sprintf("there is no ssh public key stored for user %v, but it is required for booking environment %v", r.User, r.EnvPlainName)
+			markFailure(tx, r.ID, util.StatusError, problem)
+			return c, outcome.Fail(util.StatusError, problem), false
+		}
+		c.coUserKeys = getCoUserKeys(tx, r)
+	}
+
+	err := claim(tx, r.ID, util.StatusStarting, actorGafaspot, "start time reached")
+	if err != nil {
+		return c, outcome.Fail(r.Status, err.Error()), false
+	}
+	c.pendingReset, c.hasPendingReset = getPendingReset(tx, r)
+	c.blockOnHookFailure = blocksOnHookFailure(tx, r.EnvPlainName)
+	return c, outcome, true
+}
+
+// undoIncompleteBundles ends the bookings of all bundle members which started successfully, if
+// another member of the same bundle did not start completely. Their results get replaced by
+// failed ones, so they are retried together with the other members. If ending such a booking
+// fails, the member keeps it and is recorded as partially started, so it gets ended at its end
+// time.
+func undoIncompleteBundles(claims []claimedReservation, results []util.BookingResult, endBooking endBookingFunc) {
+	bundleProblems := map[int]string{}
+	for i, c := range claims {
+		if c.r.BundleID != 0 && !results[i].Succeeded() {
+			bundleProblems[c.r.BundleID] = fmt.Sprintf("environment %v of the bundle did not start: %v", c.r.EnvPlainName, results[i].ErrorDetail())
+		}
+	}
+	for i, c := range claims {
+		problem, ok := bundleProblems[c.r.BundleID]
+		if !ok || !results[i].Succeeded() {
+			continue
 		}
+		logger.Infof("undoing start of reservation with id=%v in bundle with id=%v: %v", c.r.ID, c.r.BundleID, problem)
+		undo := endBooking(c.r.EnvPlainName, results[i].Leases())
+		if !undo.Succeeded() {
+			results[i].RevokeErr = fmt.Errorf("%v; undoing the start failed: %v", problem, undo.ErrorDetail())
+			continue
+		}
+		results[i] = util.BookingResult{EnvPlainName: c.r.EnvPlainName, Err: fmt.Errorf("%v", problem)}
+	}
+}
+
+// recordStartResult stores the result of starting the claimed reservation r in database within
+// a short transaction and returns the reservation's outcome.
+func recordStartResult(r util.Reservation, now time.Time, result util.BookingResult) util.ReservationOutcome {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	outcome := util.ReservationOutcome{Reservation: r, Action: util.ActionStart}
+	if !holdsClaim(tx, r.ID, util.StatusStarting) {
+		return outcome.Fail(util.StatusStarting, "another Gafaspot instance took over the reservation meanwhile, so the outcome was not recorded: "+result.ErrorDetail())
+	}
+	if result.Failed() {
+		if scheduleRetry(tx, r, now, util.StatusUpcoming, result.ErrorDetail()) {
+			return outcome.Fail(util.StatusUpcoming, "start failed, will retry: "+result.ErrorDetail())
+		}
+		markFailure(tx, r.ID, util.StatusFailed, result.ErrorDetail())
+		return outcome.Fail(util.StatusFailed, fmt.Sprintf("start failed %v times: %v", retryMaxAttempts, result.ErrorDetail()))
+	}
+	// whatever holds the booking in Vault must be revoked at its end
+	storeLeases(tx, r.ID, result.Leases())
+	if !result.Succeeded() {
+		markFailure(tx, r.ID, util.StatusPartial, result.ErrorDetail())
+		return outcome.Fail(util.StatusPartial, "started only partially and could not be rolled back: "+result.ErrorDetail())
+	}
+	err := changeStatus(tx, r.ID, util.StatusActive, actorGafaspot, "reservation started")
+	if err != nil {
+		return outcome.Fail(util.StatusStarting, err.Error())
+	}
+	clearRetry(tx, r.ID)
+	outcome.Status = util.StatusActive
+	return outcome
+}
 
+// sendStartMail sends an email to the user of the freshly started reservation r, if wished and
+// if mailing is enabled in gafaspot config.
+func sendStartMail(r util.Reservation, readCreds readCredsFunc) {
+	if r.SendStartMail && email.MailingEnabled {
+		mailAddress, ok := GetUserEmail(r.User)
+		if ok {
+			credsInfo := collectReservationCreds(r, readCreds)
+			email.SendBeginReservationMail(mailAddress, credsInfo)
+		} else {
+			logger.Warningf("tried to send an e-mail to user '%s', but there is not mail address stored for him in database (anymore)", r.User)
+		}
 	}
 }
 
-type endBookingFunc func(envPlainName string)
+type endBookingFunc func(envPlainName string, leases util.BookingLeases) util.BookingResult
 
-// ExpireActiveReservations selects all active reservations from database, wich have an end
-// time smaller than now. It applies the endBooking function to all environments which are
-// affected by those reservations. After, it changes the reservation's status in database.
+// ExpireActiveReservations selects all active and partially started reservations from database,
+// wich have an end time smaller than now. It applies the endBooking function to all environments
+// which are affected by those reservations. After, it changes the reservation's status in
+// database. While ending, the reservation has the transitional status 'ending'.
+// If ending the booking failed for any Secrets Engine, the reservation returns to its previous
+// status and the end gets retried by later calls with an exponential backoff. After the
+// configured number of attempts, the reservation's status becomes 'error' and the errors are
+// stored with it, as the environment might still be accessible.
+// Each reservation is handled on its own, so a problem with one reservation does not keep the
+// others from ending. The function returns one ReservationOutcome per handled reservation.
+// Like StartUpcomingReservations, the function calls Vault outside of any transaction and ends the
+// bookings concurrently. After a booking was ended, the runHooks function runs the after-end hooks
+// of the environment; their results are stored with the reservation.
 // The reason, why the endBooking function is passed as parameter
 // here is the ambition to preserve the separation of database and vault package. The time now is
 // passed because an unchanging reference is needed over several function calls to avoid
 // inconsistencies.
-func ExpireActiveReservations(now time.Time, endBooking endBookingFunc) {
+func ExpireActiveReservations(now time.Time, endBooking endBookingFunc, runHooks runHooksFunc) []util.ReservationOutcome {
+	claims, outcomes := claimActiveReservations(now)
+
+	// trigger the end of the bookings concurrently
+	results := make([]util.BookingResult, len(claims))
+	hookResults := make([][]util.HookResult, len(claims))
+	util.RunParallel(len(claims), maxParallel, func(i int) {
+		c := claims[i]
+		results[i] = util.BookingResult{EnvPlainName: c.r.EnvPlainName}
+		if c.envExists {
+			logger.Infof("Ending reservation... %+v", c.r)
+			results[i] = endBooking(c.r.EnvPlainName, c.leases)
+			if results[i].Succeeded() {
+				hookResults[i] = runHooks(util.HookAfterEnd, c.r)
+			}
+		} else {
+			logger.Infof("Ended reservation for an environment, which does not seam to exist (anymore): %+v", c.r)
+		}
+	})
+
+	for i, c := range claims {
+		storeHookResults(c.r, hookResults[i])
+		outcome := recordEndResult(c.r, now, results[i])
+		logOutcome(outcome)
+		outcomes = append(outcomes, outcome)
+
+		if outcome.Status == util.StatusExpired {
+			sendEndMail(c.r)
+		}
+	}
+	return outcomes
+}
+
+// claimActiveReservations selects all active and partially started reservations which are due
+// to end and sets their status to 'ending' within one short transaction.
+func claimActiveReservations(now time.Time) ([]claimedReservation, []util.ReservationOutcome) {
 	tx := beginTransaction()
 	defer commitTransaction(tx)
 
-	reservations := getApplicableReservations(tx, now, "active", "end")
+	claims := []claimedReservation{}
+	outcomes := []util.ReservationOutcome{}
+	reservations := getApplicableReservations(tx, now, util.StatusActive, "end")
+	reservations = append(reservations, getApplicableReservations(tx, now, util.StatusPartial, "end")...)
 	for _, r := range reservations {
+		err := claim(tx, r.ID, util.StatusEnding, actorGafaspot, "end time reached")
+		if err != nil {
+			outcome := util.ReservationOutcome{Reservation: r, Action: util.ActionEnd}.Fail(r.Status, err.Error())
+			logOutcome(outcome)
+			outcomes = append(outcomes, outcome)
+			continue
+		}
 		// check, if environment in reservation exists (and fill in the information has_ssh, which is not needed)
-		ok := check(tx, r, new(bool))
+		claims = append(claims, claimedReservation{r: r, envExists: check(tx, r, new(bool)), leases: getLeases(tx, r.ID)})
+	}
+	return claims, outcomes
+}
+
+// recordEndResult stores the result of ending the claimed reservation r in database within a
+// short transaction and returns the reservation's outcome.
+func recordEndResult(r util.Reservation, now time.Time, result util.BookingResult) util.ReservationOutcome {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	outcome := util.ReservationOutcome{Reservation: r, Action: util.ActionEnd}
+	if !holdsClaim(tx, r.ID, util.StatusEnding) {
+		return outcome.Fail(util.StatusEnding, "another Gafaspot instance took over the reservation meanwhile, so the outcome was not recorded: "+result.ErrorDetail())
+	}
+	if !result.Succeeded() {
+		errorDetail := "failed to end reservation: " + result.ErrorDetail()
+		if scheduleRetry(tx, r, now, r.Status, errorDetail) {
+			return outcome.Fail(r.Status, "end failed, will retry: "+result.ErrorDetail())
+		}
+		markFailure(tx, r.ID, util.StatusError, errorDetail)
+		return outcome.Fail(util.StatusError, fmt.Sprintf("end failed %v times: %v", retryMaxAttempts, result.ErrorDetail()))
+	}
+	err := changeStatus(tx, r.ID, util.StatusExpired, actorGafaspot, "reservation ended")
+	if err != nil {
+		return outcome.Fail(util.StatusEnding, err.Error())
+	}
+	clearRetry(tx, r.ID)
+	deleteLeases(tx, r.ID)
+	outcome.Status = util.StatusExpired
+	return outcome
+}
+
+// sendEndMail sends an email to the user of the freshly ended reservation r, if wished and if
+// mailing is enabled in gafaspot config.
+func sendEndMail(r util.Reservation) {
+	if r.SendEndMail && email.MailingEnabled {
+		mailAddress, ok := GetUserEmail(r.User)
 		if ok {
-			// trigger the end of the booking
-			logger.Infof("Ending reservation... %+v", r)
-			endBooking(r.EnvPlainName)
+			reservationInfo := collateReservationEnvironment([]util.Reservation{r})[0]
+			email.SendEndReservationMail(mailAddress, reservationInfo)
 		} else {
-			logger.Infof("Ended reservation for an environment, which does not seam to exist (anymore): %+v", r)
-		}
-		// change booking status in database
-		changeStatus(tx, r.ID, "expired")
-
-		// send email to user, if wished and if mailing is enabled in gafaspot config
-		if r.SendEndMail && email.MailingEnabled {
-			mailAddress, ok := GetUserEmail(r.User)
-			if ok {
-				reservationInfo := collateReservationEnvironment([]util.Reservation{r})[0]
-				email.SendEndReservationMail(mailAddress, reservationInfo)
-			} else {
-				logger.Warningf("tried to send an e-mail to user '%s', but there is not mail address stored for him in database (anymore)", r.User)
+			logger.Warningf("tried to send an e-mail to user '%s', but there is not mail address stored for him in database (anymore)", r.User)
+		}
+	}
+}
+
+// logOutcome writes a log entry for the outcome of starting or ending a reservation.
+func logOutcome(o util.ReservationOutcome) {
+	if o.Problem != "" {
+		logger.Warningf("reservation with id=%v for user=%v in environment %v: %v (status is now '%v')", o.Reservation.ID, o.Reservation.User, o.Reservation.EnvPlainName, o.Problem, o.Status)
+	} else {
+		logger.Infof("performed %v of reservation with id=%v for user=%v in environment %v (status is now '%v')", o.Action, o.Reservation.ID, o.Reservation.User, o.Reservation.EnvPlainName, o.Status)
+	}
+}
+
+// ResetInterruptedTransitions returns all reservations which are stuck in one of the transitional
+// statuses 'starting' or 'ending' to the status they had before. This happens if the Gafaspot
+// instance which claimed them was stopped while it performed the transition in Vault. The
+// transition gets repeated by the next reservation scan. Reservations claimed by another instance
+// are only reset if its instance lease expired at the point in time now, and the ones claimed by
+// this instance only if they were claimed by a previous run of it. So no transition which is still
+// in progress gets repeated. Call this function before scanning reservations.
+func ResetInterruptedTransitions(now time.Time) {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	rows, err := tx.Query("SELECT r.id, r.status, r.claimed_by, (SELECT e.from_status FROM reservation_events e WHERE e.reservation_id=r.id AND e.to_status=r.status ORDER BY e.time DESC, e.id DESC LIMIT 1) FROM reservations r WHERE (r.status IN (?,?)) AND ((r.claimed_by IS NULL) OR (r.claimed_by=? AND r.claimed_at<?) OR (r.claimed_by!=? AND r.claimed_by NOT IN (SELECT instance FROM instance_leases WHERE expires>?)));",
+		util.StatusStarting, util.StatusEnding, instanceName, instanceStarted, instanceName, now)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	type interrupted struct {
+		id             int
+		status         string
+		claimedBy      sql.NullString
+		previousStatus sql.NullString
+	}
+	var reservations []interrupted
+	for rows.Next() {
+		i := interrupted{}
+		err = rows.Scan(&i.id, &i.status, &i.claimedBy, &i.previousStatus)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		reservations = append(reservations, i)
+	}
+	rows.Close()
+
+	for _, i := range reservations {
+		previousStatus := i.previousStatus.String
+		if !i.previousStatus.Valid {
+			// no event recorded; assume the usual predecessor
+			previousStatus = util.StatusUpcoming
+			if i.status == util.StatusEnding {
+				previousStatus = util.StatusActive
 			}
 		}
+		logger.Warningf("reservation with id=%v was interrupted while %v; set it back to '%v'", i.id, i.status, previousStatus)
+		reason := "transition interrupted by Gafaspot restart"
+		if i.claimedBy.Valid && i.claimedBy.String != instanceName {
+			reason = fmt.Sprintf("transition interrupted, as Gafaspot instance '%v' stopped", i.claimedBy.String)
+		}
+		changeStatus(tx, i.id, previousStatus, actorGafaspot, reason)
 	}
 }
 
-// DeleteOldReservations selects all expired reservations from database, which have a delete_on time
-// smaller than now. It deletes all those reservations from database.
+// DeleteOldReservations selects all reservations from database which reached a terminal status
+// and have a delete_on time smaller than now. It deletes all those reservations from database.
 func DeleteOldReservations(now time.Time) {
 	tx := beginTransaction()
 	defer commitTransaction(tx)
 
-	reservations := getApplicableReservations(tx, now, "expired", "delete_on")
-	reservations = append(reservations, getApplicableReservations(tx, now, "error", "delete_on")...)
+	reservations := getApplicableReservations(tx, now, util.StatusExpired, "delete_on")
+	reservations = append(reservations, getApplicableReservations(tx, now, util.StatusError, "delete_on")...)
+	reservations = append(reservations, getApplicableReservations(tx, now, util.StatusFailed, "delete_on")...)
+	reservations = append(reservations, getApplicableReservations(tx, now, util.StatusAborted, "delete_on")...)
+	reservations = append(reservations, getApplicableReservations(tx, now, util.StatusRejected, "delete_on")...)
 	for _, r := range reservations {
 
 		// delete booking from database
 		deleteReservation(tx, r.ID)
 	}
+
+	// delete series whose occurrences are all gone
+	_, err := tx.Exec("DELETE FROM reservation_series WHERE id NOT IN (SELECT series_id FROM reservations WHERE series_id IS NOT NULL);")
+	if err != nil {
+		logger.Errorf("did not delete reservation series due to following error: %v\n", err)
+	}
+	// the same for bundles
+	_, err = tx.Exec("DELETE FROM reservation_bundles WHERE id NOT IN (SELECT bundle_id FROM reservations WHERE bundle_id IS NOT NULL);")
+	if err != nil {
+		logger.Errorf("did not delete reservation bundles due to following error: %v\n", err)
+	}
+	// maintenance windows added at runtime are not needed anymore when they are over
+	_, err = tx.Exec("DELETE FROM maintenance_windows WHERE (from_config=0) AND (end<?);", now)
+	if err != nil {
+		logger.Errorf("did not delete maintenance windows due to following error: %v\n", err)
+	}
 }
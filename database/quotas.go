@@ -0,0 +1,314 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// quotas are the booking quotas from config file. Vault policies and usernames are compared in
+// lower case, as the config file's keys are.
+var quotas util.QuotasConfig
+
+// quotaFor determines the booking quota which applies to the user username: The user's own entry,
+// if there is one, otherwise the most generous limits of all of the user's groups which have an
+// entry, otherwise the default quota.
+func quotaFor(tx *sql.Tx, username string) util.QuotaConfig {
+	if q, ok := quotas.Users[strings.ToLower(username)]; ok {
+		return q
+	}
+	var q util.QuotaConfig
+	found := false
+	for _, group := range getUserGroups(tx, username) {
+		gq, ok := quotas.Groups[strings.ToLower(group)]
+		if !ok {
+			continue
+		}
+		if !found {
+			q = gq
+			found = true
+			continue
+		}
+		q.MaxConcurrent = moreGenerous(q.MaxConcurrent, gq.MaxConcurrent)
+		q.MaxUpcoming = moreGenerous(q.MaxUpcoming, gq.MaxUpcoming)
+		// the booked hours are compared by the hours per day they allow
+		if q.MaxHours != 0 && (gq.MaxHours == 0 || float64(gq.MaxHours)/float64(gq.WindowDays) > float64(q.MaxHours)/float64(q.WindowDays)) {
+			q.MaxHours, q.WindowDays = gq.MaxHours, gq.WindowDays
+		}
+	}
+	if found {
+		return q
+	}
+	return quotas.Default
+}
+
+// moreGenerous returns the higher of two limits, where zero means no limit.
+func moreGenerous(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// checkQuota checks whether the user may hold the reservations rs in addition to the reservations
+// already stored in database. rs are new or changed reservations of the same user; stored
+// reservations with the same ids are ignored, so changed reservations do not count twice. If rs
+// exceed the user's quota, the function returns a ReservationError.
+func checkQuota(tx *sql.Tx, rs []util.Reservation) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	username := rs[0].User
+	q := quotaFor(tx, username)
+	if q == (util.QuotaConfig{}) {
+		return nil
+	}
+
+	if q.MaxUpcoming != 0 {
+		upcoming := 0
+		for _, r := range rs {
+			if r.Status == "" || r.Status == util.StatusUpcoming || r.Status == util.StatusPending {
+				upcoming++
+			}
+		}
+		if upcoming > 0 {
+			upcoming += countUpcoming(tx, username, rs)
+			if upcoming > q.MaxUpcoming {
+				return ReservationError(fmt.Sprintf("you may have at most %v upcoming reservations, this would make %v", q.MaxUpcoming, upcoming))
+			}
+		}
+	}
+
+	// all reservations which count against the quota and lie near rs
+	window := time.Duration(q.WindowDays) * 24 * time.Hour
+	from, until := rs[0].Start, rs[0].End
+	for _, r := range rs {
+		if r.Start.Before(from) {
+			from = r.Start
+		}
+		if r.End.After(until) {
+			until = r.End
+		}
+	}
+	all := append(getQuotaReservations(tx, username, rs, from.Add(-window), until.Add(window)), rs...)
+
+	if q.MaxConcurrent != 0 {
+		// the number of reservations only rises at their starts
+		for _, r := range rs {
+			for _, o := range all {
+				if o.Start.Before(r.Start) || !o.Start.Before(r.End) {
+					continue
+				}
+				held := 0
+				for _, x := range all {
+					if !x.Start.After(o.Start) && x.End.After(o.Start) {
+						held++
+					}
+				}
+				if held > q.MaxConcurrent {
+					return ReservationError(fmt.Sprintf("you may hold at most %v reservations at the same time, but at %v you would hold %v", q.MaxConcurrent, o.Start.Format(util.TimeLayout), held))
+				}
+			}
+		}
+	}
+
+	if q.MaxHours != 0 {
+		// the booked time within a window is largest when the window starts or ends at a start or end of a reservation
+		limit := time.Duration(q.MaxHours) * time.Hour
+		for _, o := range all {
+			for _, bound := range []time.Time{o.Start, o.End} {
+				for _, windowStart := range []time.Time{bound, bound.Add(-window)} {
+					windowEnd := windowStart.Add(window)
+					if !touchesAny(rs, windowStart, windowEnd) {
+						continue
+					}
+					booked := time.Duration(0)
+					for _, x := range all {
+						booked += overlap(x, windowStart, windowEnd)
+					}
+					if booked > limit {
+						return ReservationError(fmt.Sprintf("you may book at most %v hours within %v days, but from %v to %v you would have booked %v hours", q.MaxHours, q.WindowDays, windowStart.Format(util.TimeLayout), windowEnd.Format(util.TimeLayout), math.Ceil(booked.Hours())))
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// countUpcoming counts the upcoming reservations of user username in database, leaving out the
+// reservations rs. Reservations which wait for approval count as upcoming.
+func countUpcoming(tx *sql.Tx, username string, rs []util.Reservation) int {
+	count := 0
+	for _, r := range getUserReservationsWithStatus(tx, username, notStartedStatuses) {
+		if !containsReservation(rs, r.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+// getQuotaReservations fetches all reservations of user username which count against the quota
+// and overlap the time range from start to end. Those are all reservations which occupy their
+// environment and all expired ones. The reservations rs are left out.
+func getQuotaReservations(tx *sql.Tx, username string, rs []util.Reservation, start, end time.Time) []util.Reservation {
+	statuses := append([]string{util.StatusExpired}, blockingStatuses...)
+	reservations := []util.Reservation{}
+	for _, r := range getUserReservationsWithStatus(tx, username, statuses) {
+		if r.Start.Before(end) && r.End.After(start) && !containsReservation(rs, r.ID) {
+			reservations = append(reservations, r)
+		}
+	}
+	return reservations
+}
+
+// getUserReservationsWithStatus fetches all reservations of user username with one of the given
+// statuses.
+func getUserReservationsWithStatus(tx *sql.Tx, username string, statuses []string) []util.Reservation {
+	args := append([]interface{}{username}, statusArgs(statuses)...)
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (username=?) AND (status IN ("+statusPlaceholders(statuses)+"));", args...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	return assembleReservations(rows)
+}
+
+// containsReservation tells whether one of the reservations rs has the given id. New reservations
+// have no id yet, so they are never contained.
+func containsReservation(rs []util.Reservation, id int) bool {
+	for _, r := range rs {
+		if r.ID != 0 && r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// touchesAny tells whether one of the reservations rs overlaps the time range from start to end.
+func touchesAny(rs []util.Reservation, start, end time.Time) bool {
+	for _, r := range rs {
+		if r.Start.Before(end) && r.End.After(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlap returns how much of the reservation r lies within the time range from start to end.
+func overlap(r util.Reservation, start, end time.Time) time.Duration {
+	if r.Start.After(start) {
+		start = r.Start
+	}
+	if r.End.Before(end) {
+		end = r.End
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// SaveUserGroups stores the groups of user username, which are the Vault policies Vault assigned
+// to the user at LDAP login. They determine the user's booking quota. The groups get deleted
+// together with old user entries, if the user does not log in anymore.
+func SaveUserGroups(username string, groups []string) {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	_, err := tx.Exec("DELETE FROM user_groups WHERE username=?;", username)
+	if err != nil {
+		logger.Error(err)
+	}
+	deleteOn := addTTL(time.Now())
+	for _, group := range groups {
+		_, err = tx.Exec("INSERT INTO user_groups (username, group_name, delete_on) VALUES(?,?,?);", username, group, deleteOn)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// getUserGroups fetches the groups of user username which were stored at the user's last login.
+func getUserGroups(tx *sql.Tx, username string) []string {
+	rows, err := tx.Query("SELECT group_name FROM user_groups WHERE username=?;", username)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	groups := []string{}
+	for rows.Next() {
+		var group string
+		err = rows.Scan(&group)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// getGroupMembers fetches all users who had group among their groups at their last login. Group
+// names are compared case-insensitively.
+func getGroupMembers(tx *sql.Tx, group string) []string {
+	rows, err := tx.Query("SELECT DISTINCT username FROM user_groups WHERE group_name=? COLLATE NOCASE ORDER BY username;", group)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		members = append(members, username)
+	}
+	return members
+}
+
+// UserHasGroup checks whether group was among the groups of user username at the user's last login.
+// Group names are compared case-insensitively.
+func UserHasGroup(username, group string) bool {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	for _, g := range getUserGroups(tx, username) {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
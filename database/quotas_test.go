@@ -0,0 +1,134 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// storeQuotaTestReservation writes a reservation of user username directly to the database.
+func storeQuotaTestReservation(t *testing.T, username, status string, start, end time.Time) int {
+	result, err := db.Exec("INSERT INTO reservations (status, username, env_plain_name, start, end, delete_on) VALUES(?,?,?,?,?,?);",
+		status, username, "demo0", start, end, addTTL(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+func TestQuotaFor(t *testing.T) {
+	defaultQuota := util.QuotaConfig{MaxConcurrent: 1, MaxUpcoming: 3, MaxHours: 10, WindowDays: 1}
+	small := util.QuotaConfig{MaxConcurrent: 2, MaxUpcoming: 5, MaxHours: 20, WindowDays: 1}
+	// more concurrent reservations and no limit for upcoming ones, but fewer hours per day
+	wide := util.QuotaConfig{MaxConcurrent: 3, MaxHours: 70, WindowDays: 7}
+	hourless := util.QuotaConfig{MaxConcurrent: 1, MaxUpcoming: 1}
+	defer initTestDB(t, util.GafaspotConfig{Quotas: util.QuotasConfig{
+		Default: defaultQuota,
+		Users:   map[string]util.QuotaConfig{"boss": {}},
+		Groups:  map[string]util.QuotaConfig{"small": small, "wide": wide, "hourless": hourless},
+	}})()
+
+	tests := []struct {
+		username string
+		groups   []string
+		want     util.QuotaConfig
+	}{
+		{username: "nogroups", want: defaultQuota},
+		{username: "unknowngroups", groups: []string{"default", "other"}, want: defaultQuota},
+		{username: "onegroup", groups: []string{"Small", "other"}, want: small},
+		{username: "smallwide", groups: []string{"small", "wide"}, want: util.QuotaConfig{MaxConcurrent: 3, MaxHours: 20, WindowDays: 1}},
+		{username: "widesmall", groups: []string{"wide", "small"}, want: util.QuotaConfig{MaxConcurrent: 3, MaxHours: 20, WindowDays: 1}},
+		{username: "smallhourless", groups: []string{"small", "hourless"}, want: util.QuotaConfig{MaxConcurrent: 2, MaxUpcoming: 5}},
+		{username: "hourlesssmall", groups: []string{"hourless", "small"}, want: util.QuotaConfig{MaxConcurrent: 2, MaxUpcoming: 5}},
+		{username: "Boss", groups: []string{"small"}, want: util.QuotaConfig{}},
+	}
+	for _, test := range tests {
+		SaveUserGroups(test.username, test.groups)
+		tx := beginTransaction()
+		got := quotaFor(tx, test.username)
+		commitTransaction(tx)
+		if got != test.want {
+			t.Errorf("quotaFor(%v) with groups %v = %+v, want %+v", test.username, test.groups, got, test.want)
+		}
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	defer initTestDB(t, util.GafaspotConfig{Quotas: util.QuotasConfig{
+		Default: util.QuotaConfig{MaxConcurrent: 1, MaxHours: 10, WindowDays: 1},
+	}})()
+	base := time.Now().Add(48 * time.Hour).Truncate(time.Hour)
+
+	type span struct {
+		status string
+		from   int
+		to     int
+	}
+	tests := []struct {
+		name    string
+		stored  []span
+		new     []span
+		changed bool
+		wantErr bool
+	}{
+		{name: "hours exactly at the limit", stored: []span{{util.StatusExpired, 0, 4}}, new: []span{{"", 4, 10}}},
+		{name: "hours above the limit", stored: []span{{util.StatusExpired, 0, 4}}, new: []span{{"", 4, 11}}, wantErr: true},
+		{name: "hours above the limit within a window across two days", stored: []span{{util.StatusExpired, 10, 16}}, new: []span{{"", 26, 32}}, wantErr: true},
+		{name: "hours within the limit, as the window slid past the older reservation", stored: []span{{util.StatusExpired, 10, 16}}, new: []span{{"", 40, 46}}},
+		{name: "hours above the limit within the new reservations", new: []span{{"", 0, 6}, {"", 12, 18}}, wantErr: true},
+		{name: "aborted and failed reservations do not count", stored: []span{{util.StatusAborted, 0, 4}, {util.StatusFailed, 4, 8}}, new: []span{{"", 8, 16}}},
+		{name: "changed reservation does not count twice", stored: []span{{util.StatusUpcoming, 0, 6}}, new: []span{{util.StatusUpcoming, 0, 8}}, changed: true},
+		{name: "concurrent reservations", stored: []span{{util.StatusUpcoming, 0, 4}}, new: []span{{"", 2, 3}}, wantErr: true},
+		{name: "back to back reservations", stored: []span{{util.StatusUpcoming, 0, 4}}, new: []span{{"", 4, 8}}},
+	}
+	for _, test := range tests {
+		if _, err := db.Exec("DELETE FROM reservations;"); err != nil {
+			t.Fatal(err)
+		}
+		id := 0
+		for _, s := range test.stored {
+			id = storeQuotaTestReservation(t, "user", s.status, base.Add(time.Duration(s.from)*time.Hour), base.Add(time.Duration(s.to)*time.Hour))
+		}
+		rs := []util.Reservation{}
+		for _, s := range test.new {
+			r := util.Reservation{User: "user", EnvPlainName: "demo1", Status: s.status, Start: base.Add(time.Duration(s.from) * time.Hour), End: base.Add(time.Duration(s.to) * time.Hour)}
+			if test.changed {
+				r.ID = id
+			}
+			rs = append(rs, r)
+		}
+
+		tx := beginTransaction()
+		err := checkQuota(tx, rs)
+		commitTransaction(tx)
+		if test.wantErr && err == nil {
+			t.Errorf("%v: expected a quota error", test.name)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"html/template"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/AdvUni/gafaspot/util"
 )
@@ -76,7 +77,7 @@ func getUserAttribute(username, attribute string) (string, bool) {
 
 // GetEnvironments reads all environments from database and returns them as a map with the PlainNames as keys.
 func GetEnvironments() map[string]util.Environment {
-	rows, err := db.Query("SELECT env_plain_name, env_nice_name, has_ssh, description FROM environments ORDER BY env_nice_name;")
+	rows, err := db.Query("SELECT env_plain_name, env_nice_name, has_ssh, description, waitlist_policy, cleanup_buffer, requires_approval, approver_policy FROM environments ORDER BY env_nice_name;")
 	if err != nil {
 		logger.Error(err)
 		return nil
@@ -87,11 +88,15 @@ func GetEnvironments() map[string]util.Environment {
 	for rows.Next() {
 		e := util.Environment{}
 		description := sql.NullString{}
-		err := rows.Scan(&e.PlainName, &e.NiceName, &e.HasSSH, &description)
+		var cleanupBuffer int64
+		approverPolicy := sql.NullString{}
+		err := rows.Scan(&e.PlainName, &e.NiceName, &e.HasSSH, &description, &e.WaitlistPolicy, &cleanupBuffer, &e.RequiresApproval, &approverPolicy)
 		if err != nil {
 			logger.Emergency(err)
 			os.Exit(1)
 		}
+		e.CleanupBuffer = time.Duration(cleanupBuffer) * time.Second
+		e.ApproverPolicy = approverPolicy.String
 		if description.Valid {
 			e.Description = template.HTML(description.String)
 		}
@@ -106,16 +111,28 @@ func GetEnvReservations(envPlainName string) []util.Reservation {
 	return getReservations("env_plain_name", envPlainName)
 }
 
-// GetUserReservations returns all reservations stored in database for a specific username.
+// GetUserReservations returns all reservations stored in database for a specific username,
+// including the ones other users share with the user. The reservations' CoUsers are filled.
 func GetUserReservations(username string) []util.Reservation {
-	return getReservations("username", username)
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (username=?) OR id IN (SELECT reservation_id FROM reservation_co_users WHERE username=?);", username, username)
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	reservations := assembleReservations(rows)
+	rows.Close()
+	fillCoUsers(tx, reservations)
+	return reservations
 }
 
 // getReservations allows to select all reservations from database by one specific condition. The
 // condition is: 'WHERE conditionKey=conditionVal', where conditionKey and conditionVal are
 // function parameters.
 func getReservations(conditionKey, conditionVal string) []util.Reservation {
-	stmtstring := fmt.Sprintf("SELECT id, status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail FROM reservations WHERE %v=?", conditionKey)
+	stmtstring := fmt.Sprintf("SELECT %s FROM reservations WHERE %v=?", reservationColumns, conditionKey)
 	stmt, err := db.Prepare(stmtstring)
 	if err != nil {
 		logger.Emergency(err)
@@ -132,9 +149,48 @@ func getReservations(conditionKey, conditionVal string) []util.Reservation {
 	return assembleReservations(rows)
 }
 
+// GetUserReservationEvents returns the recorded events of all reservations of a specific user,
+// including the ones other users share with the user. The result maps each reservation id to the
+// reservation's events in chronological order.
+func GetUserReservationEvents(username string) map[int][]util.ReservationEvent {
+	stmt, err := db.Prepare("SELECT e.reservation_id, e.time, e.from_status, e.to_status, e.actor, e.reason FROM reservation_events e JOIN reservations r ON e.reservation_id=r.id WHERE (r.username=?) OR r.id IN (SELECT reservation_id FROM reservation_co_users WHERE username=?) ORDER BY e.time, e.id;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username, username)
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	defer rows.Close()
+
+	events := make(map[int][]util.ReservationEvent)
+	for rows.Next() {
+		e := util.ReservationEvent{}
+		var fromStatus, reason sql.NullString
+		err := rows.Scan(&e.ReservationID, &e.Time, &fromStatus, &e.ToStatus, &e.Actor, &reason)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if fromStatus.Valid {
+			e.FromStatus = fromStatus.String
+		}
+		if reason.Valid {
+			e.Reason = reason.String
+		}
+		events[e.ReservationID] = append(events[e.ReservationID], e)
+	}
+	return events
+}
+
 // CollectUserCreds bundles all valid credentials for a user. It searches for the user's
-// reservations with status 'active', adds the Environment information and looks up the
-// corresponding credentials.
+// reservations with status 'active' or 'partial', adds the Environment information and looks up the
+// corresponding credentials. Reservations which other users share with the user are included; for
+// them, the credentials are read for the user as co-user.
 // As reading credentials from vault is a matter of the vault package, and it is tried to
 // keep the packages database and vault separately, the readCreds function is passed as
 // parameter.
@@ -142,15 +198,15 @@ func getReservations(conditionKey, conditionVal string) []util.Reservation {
 // creates kind of a dummy Environment struct using the EnvPlainName given in the Reservation.
 // No error or similar will arise.
 func CollectUserCreds(username string, readCreds readCredsFunc) []util.ReservationCreds {
-	// get all active reservations of user
-	stmt, err := db.Prepare("SELECT id, status, username, env_plain_name, start, end, subject, labels, start_mail, end_mail FROM reservations WHERE (status='active') AND (username=?);")
+	// get all active reservations of user; partially started ones may provide some credentials as well
+	stmt, err := db.Prepare("SELECT " + reservationColumns + " FROM reservations WHERE (status IN ('active', 'partial')) AND ((username=?) OR id IN (SELECT reservation_id FROM reservation_co_users WHERE username=?));")
 	if err != nil {
 		logger.Emergency(err)
 		os.Exit(1)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(username)
+	rows, err := stmt.Query(username, username)
 	if err != nil {
 		logger.Error(err)
 	}
@@ -166,7 +222,11 @@ func CollectUserCreds(username string, readCreds readCredsFunc) []util.Reservati
 
 	// add creds info
 	for i := range resEnvCreds {
-		resEnvCreds[i].Creds = readCreds(resEnvCreds[i].Env.PlainName)
+		coUser := ""
+		if resEnvCreds[i].Res.User != username {
+			coUser = username
+		}
+		resEnvCreds[i].Creds = readCreds(resEnvCreds[i].Env.PlainName, coUser)
 	}
 
 	return resEnvCreds
@@ -185,7 +245,7 @@ func CollectUserCreds(username string, readCreds readCredsFunc) []util.Reservati
 // return proper values.
 func collectReservationCreds(reservation util.Reservation, readCreds readCredsFunc) util.ReservationCreds {
 	reservationCreds := collateReservationEnvironment([]util.Reservation{reservation})[0]
-	reservationCreds.Creds = readCreds(reservation.EnvPlainName)
+	reservationCreds.Creds = readCreds(reservation.EnvPlainName, "")
 	return reservationCreds
 }
 
@@ -0,0 +1,258 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+type inspectCredsFunc func(envPlainName string) (map[string]bool, error)
+
+// holdingStatuses are the statuses of reservations for which credentials may be stored in Vault.
+var holdingStatuses = []string{util.StatusStarting, util.StatusActive, util.StatusPartial, util.StatusEnding}
+
+// reconciliationRequested gets a signal whenever a user requests a reconciliation through the web
+// interface of this Gafaspot instance. Requests from other instances are noticed through table
+// reconciliation_requests.
+var reconciliationRequested = make(chan struct{}, 1)
+
+// ReconciliationRequested returns a channel which receives a signal whenever a reconciliation
+// was requested through this Gafaspot instance. Use TakeReconciliationRequests to find out about
+// requests through any instance.
+func ReconciliationRequested() <-chan struct{} {
+	return reconciliationRequested
+}
+
+// RequestReconciliation stores the request of user username to reconcile the database with Vault.
+// The Gafaspot instance which scans reservations performs the reconciliation.
+func RequestReconciliation(username string) {
+	_, err := db.Exec("INSERT INTO reconciliation_requests (time, username) VALUES (?,?);", time.Now(), username)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Infof("user %v requested a reconciliation", username)
+	select {
+	case reconciliationRequested <- struct{}{}:
+	default:
+	}
+}
+
+// TakeReconciliationRequests deletes all pending reconciliation requests and returns, whether
+// there were any.
+func TakeReconciliationRequests() bool {
+	res, err := db.Exec("DELETE FROM reconciliation_requests;")
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	return n > 0
+}
+
+// ReconcileReservations compares the reservations in database with the credentials stored in
+// Vault for each environment. This reveals inconsistencies which remain after Gafaspot crashed
+// or Vault was not reachable:
+// If Vault stores credentials for an environment which is not held by any reservation, the
+// credentials are orphaned. Gafaspot ends the booking for the environment with the endBooking
+// function to get rid of them.
+// If there is an active reservation for an environment, but Vault does not store credentials for
+// all of its Secrets Engines, Gafaspot can not fix this on its own. It records the problem with
+// the reservation, so the user and the administrator see it.
+// The inspectCreds and endBooking functions are passed as parameters to preserve the separation
+// of database and vault package. The function returns a report of all findings.
+func ReconcileReservations(now time.Time, inspectCreds inspectCredsFunc, endBooking endBookingFunc) util.ReconciliationReport {
+	report := util.ReconciliationReport{Time: now}
+
+	envPlainNames := []string{}
+	for envPlainName := range GetEnvironments() {
+		envPlainNames = append(envPlainNames, envPlainName)
+	}
+	sort.Strings(envPlainNames)
+	report.Environments = len(envPlainNames)
+
+	// inspect all environments concurrently
+	inspected := time.Now()
+	stored := make([]map[string]bool, len(envPlainNames))
+	errs := make([]error, len(envPlainNames))
+	util.RunParallel(len(envPlainNames), maxParallel, func(i int) {
+		stored[i], errs[i] = inspectCreds(envPlainNames[i])
+	})
+
+	holding := getHoldingReservations()
+	for i, envPlainName := range envPlainNames {
+		if errs[i] != nil {
+			report.Findings = append(report.Findings, util.ReconciliationFinding{
+				EnvPlainName: envPlainName,
+				Kind:         util.FindingInspectionFailed,
+				Detail:       errs[i].Error(),
+			})
+			continue
+		}
+
+		// while a reservation starts or ends, Vault and database do not match for a short time;
+		// such environments are left to the next reconciliation
+		reservations, ok := holding[envPlainName]
+		if inTransition(reservations) || statusChangedSince(envPlainName, inspected) {
+			logger.Infof("skipped reconciliation of environment %v, as one of its reservations is starting or ending", envPlainName)
+			continue
+		}
+		if !ok {
+			if f, ok := reconcileOrphanedCreds(envPlainName, stored[i], inspected, endBooking); ok {
+				report.Findings = append(report.Findings, f)
+			}
+			continue
+		}
+		for _, r := range reservations {
+			// only for active reservations, credentials are expected for each Secrets Engine
+			if r.Status != util.StatusActive {
+				continue
+			}
+			if f, ok := reconcileMissingCreds(r, stored[i]); ok {
+				report.Findings = append(report.Findings, f)
+			}
+		}
+	}
+	return report
+}
+
+// reconcileOrphanedCreds ends the booking for the environment envPlainName, if stored tells that
+// there are credentials stored in Vault. stored was read at the point in time inspected; if a
+// reservation for the environment started meanwhile, the credentials are not orphaned. The second
+// return value tells, whether there was anything to do.
+func reconcileOrphanedCreds(envPlainName string, stored map[string]bool, inspected time.Time, endBooking endBookingFunc) (util.ReconciliationFinding, bool) {
+	secEngs := storedSecEngs(stored, true)
+	if len(secEngs) == 0 || statusChangedSince(envPlainName, inspected) {
+		return util.ReconciliationFinding{}, false
+	}
+
+	f := util.ReconciliationFinding{EnvPlainName: envPlainName, Kind: util.FindingOrphanedCreds}
+	logger.Warningf("found orphaned credentials in environment %v for Secrets Engines %v; ending booking", envPlainName, secEngs)
+	// nothing is known about the leases of orphaned credentials
+	result := endBooking(envPlainName, util.BookingLeases{})
+	if result.Succeeded() {
+		f.Detail = fmt.Sprintf("credentials for %v were stored without reservation and got removed", strings.Join(secEngs, ", "))
+		f.Resolved = true
+	} else {
+		f.Detail = fmt.Sprintf("credentials for %v are stored without reservation, but ending the booking failed: %v", strings.Join(secEngs, ", "), result.ErrorDetail())
+	}
+	return f, true
+}
+
+// reconcileMissingCreds records a problem with the active reservation r, if stored tells that
+// there are not credentials stored in Vault for all Secrets Engines of its environment. The
+// second return value tells, whether there was anything to record.
+func reconcileMissingCreds(r util.Reservation, stored map[string]bool) (util.ReconciliationFinding, bool) {
+	secEngs := storedSecEngs(stored, false)
+	if len(secEngs) == 0 {
+		return util.ReconciliationFinding{}, false
+	}
+
+	detail := fmt.Sprintf("reservation is active, but there are no credentials stored for %v", strings.Join(secEngs, ", "))
+
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+	var status string
+	var errorDetail sql.NullString
+	err := tx.QueryRow("SELECT status, error_detail FROM reservations WHERE id=?;", r.ID).Scan(&status, &errorDetail)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	// the reservation may have ended meanwhile, so its credentials are rightly gone
+	if status != util.StatusActive {
+		return util.ReconciliationFinding{}, false
+	}
+	logger.Warningf("reservation with id=%v for user=%v in environment %v: %v", r.ID, r.User, r.EnvPlainName, detail)
+
+	// a problem which is already known is not recorded again by each reconciliation
+	if errorDetail.String != detail {
+		_, err = tx.Exec("UPDATE reservations SET error_detail=? WHERE id=?;", detail, r.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		// the status stays the same, but the event makes the problem visible in the reservation's history
+		recordEvent(tx, r.ID, r.Status, r.Status, actorGafaspot, "reconciliation: "+detail)
+	}
+
+	return util.ReconciliationFinding{EnvPlainName: r.EnvPlainName, ReservationID: r.ID, Kind: util.FindingMissingCreds, Detail: detail}, true
+}
+
+// storedSecEngs returns the sorted names of all Secrets Engines for which stored has the value want.
+func storedSecEngs(stored map[string]bool, want bool) []string {
+	secEngs := []string{}
+	for name, isStored := range stored {
+		if isStored == want {
+			secEngs = append(secEngs, name)
+		}
+	}
+	sort.Strings(secEngs)
+	return secEngs
+}
+
+// inTransition tells whether one of the reservations rs is starting or ending right now.
+func inTransition(rs []util.Reservation) bool {
+	for _, r := range rs {
+		if r.Status == util.StatusStarting || r.Status == util.StatusEnding {
+			return true
+		}
+	}
+	return false
+}
+
+// statusChangedSince tells whether the status of a reservation for environment envPlainName
+// changed since the point in time since.
+func statusChangedSince(envPlainName string, since time.Time) bool {
+	var changed bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM reservation_events e JOIN reservations r ON e.reservation_id=r.id WHERE (r.env_plain_name=?) AND (e.time>=?) AND (e.from_status!=e.to_status));", envPlainName, since).Scan(&changed)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	return changed
+}
+
+// getHoldingReservations returns all reservations for which credentials may be stored in Vault,
+// grouped by environment.
+func getHoldingReservations() map[string][]util.Reservation {
+	rows, err := db.Query("SELECT "+reservationColumns+" FROM reservations WHERE status IN ("+statusPlaceholders(holdingStatuses)+");", statusArgs(holdingStatuses)...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	holding := make(map[string][]util.Reservation)
+	for _, r := range assembleReservations(rows) {
+		holding[r.EnvPlainName] = append(holding[r.EnvPlainName], r)
+	}
+	return holding
+}
@@ -0,0 +1,85 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// scheduleChanged gets a signal whenever reservations were changed in a way which may affect the
+// point in time of the next start or end. It is buffered, so notifying never blocks and several
+// changes in a row result in only one signal.
+var scheduleChanged = make(chan struct{}, 1)
+
+// ScheduleChanged returns a channel which receives a signal whenever a reservation was created or
+// changed, so that the next point in time returned by NextTransitionTime may be different.
+func ScheduleChanged() <-chan struct{} {
+	return scheduleChanged
+}
+
+// notifyScheduleChanged signals a change to the reservation schedule without blocking.
+func notifyScheduleChanged() {
+	select {
+	case scheduleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// NextTransitionTime returns the earliest point in time at which a reservation needs to be
+// started or ended. For reservations waiting for a retry, the time of the retry counts. Pending
+// reservations count with their start, as they get rejected if nobody approved them until then.
+// If there is no reservation to start or end at all, the second return value is false.
+func NextTransitionTime() (time.Time, bool) {
+	rows, err := db.Query("SELECT status, start, end, next_retry FROM reservations WHERE status IN (?,?,?,?);", util.StatusPending, util.StatusUpcoming, util.StatusActive, util.StatusPartial)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	var next time.Time
+	found := false
+	for rows.Next() {
+		var status string
+		var start, end time.Time
+		var nextRetry sql.NullTime
+		err = rows.Scan(&status, &start, &end, &nextRetry)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+
+		t := end
+		if status == util.StatusUpcoming || status == util.StatusPending {
+			t = start
+		}
+		if nextRetry.Valid && nextRetry.Time.After(t) {
+			t = nextRetry.Time
+		}
+		if !found || t.Before(next) {
+			next = t
+			found = true
+		}
+	}
+	return next, found
+}
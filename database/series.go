@@ -0,0 +1,260 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+const (
+	// maxSeriesOccurrences limits the number of reservations one series can create.
+	maxSeriesOccurrences = 200
+	// maxListedProblems limits the number of occurrences listed in an error message, which is
+	// shown to the user.
+	maxListedProblems = 5
+)
+
+// CreateReservationSeries creates a series of reservations which repeat according to rule. r is
+// the first occurrence; all others get the same duration, subject and mail flags. Each occurrence
+// gets validated like a single reservation with CreateReservation. Occurrences which are not
+// possible, mostly because of conflicts with existing reservations, are returned as
+// SeriesConflicts. If skipConflicts is false, a single such occurrence prevents the whole series
+// from being created, and the function returns a ReservationError. Otherwise, the series is
+// created without the conflicting occurrences. The created reservations are returned.
+func CreateReservationSeries(r util.Reservation, rule util.RecurrenceRule, skipConflicts bool) ([]util.Reservation, []util.SeriesConflict, error) {
+	starts := rule.Occurrences(r.Start, maxSeriesOccurrences)
+	if len(starts) > maxSeriesOccurrences {
+		return nil, nil, ReservationError(fmt.Sprintf("a series may have at most %v occurrences", maxSeriesOccurrences))
+	}
+	duration := r.End.Sub(r.Start)
+
+	// start a transaction; the scheduler and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+
+	err := checkRequirements(tx, r)
+	if err != nil {
+		rollbackTransaction(tx)
+		return nil, nil, err
+	}
+
+	res, err := tx.Exec("INSERT INTO reservation_series (username, env_plain_name, rule, created) VALUES(?,?,?,?);", r.User, r.EnvPlainName, rule.String(), time.Now())
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	seriesID, err := res.LastInsertId()
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+
+	created := []util.Reservation{}
+	conflicts := []util.SeriesConflict{}
+	for _, start := range starts {
+		occurrence := r
+		occurrence.Start = start
+		occurrence.End = start.Add(duration)
+		occurrence.SeriesID = int(seriesID)
+
+		// occurrences are checked against each other as well, as the earlier ones are already inserted
+		err = checkTimes(&occurrence)
+		if err == nil {
+			err = checkConflicts(tx, occurrence.EnvPlainName, occurrence.Start, occurrence.End, 0)
+		}
+		if err == nil {
+			err = checkQuota(tx, []util.Reservation{occurrence})
+		}
+		if err != nil {
+			conflicts = append(conflicts, util.SeriesConflict{Start: start, End: start.Add(duration), Reason: reasonOf(err)})
+			continue
+		}
+
+		occurrence.ID, err = insertReservation(tx, occurrence, fmt.Sprintf("reservation created as part of series %v", seriesID))
+		if err != nil {
+			logger.Error(err)
+			rollbackTransaction(tx)
+			return nil, nil, fmt.Errorf("not able to create reservation series")
+		}
+		created = append(created, occurrence)
+	}
+
+	if len(created) == 0 {
+		rollbackTransaction(tx)
+		return nil, conflicts, ReservationError(fmt.Sprintf("none of the %v occurrences is possible: %v", len(starts), listConflicts(conflicts)))
+	}
+	if len(conflicts) > 0 && !skipConflicts {
+		rollbackTransaction(tx)
+		return nil, conflicts, ReservationError(fmt.Sprintf("%v of %v occurrences are not possible; skip them or change the series: %v", len(conflicts), len(starts), listConflicts(conflicts)))
+	}
+	commitTransaction(tx)
+	logger.Infof("created reservation series %v with %v occurrences; skipped %v", seriesID, len(created), len(conflicts))
+	return created, conflicts, nil
+}
+
+// UpdateReservationSeries changes all upcoming occurrences of a series in one step. r.ID is the
+// occurrence which the user edited and r.Start and r.End are its new times. All other upcoming
+// occurrences get shifted by the same amount of time and get the same new duration. Subject and
+// mail flags are taken over by all of them. Each changed occurrence gets validated like a single
+// reservation with UpdateReservation. If any of them is invalid, nothing gets changed and the
+// function returns a ReservationError listing the invalid occurrences.
+func UpdateReservationSeries(r util.Reservation) error {
+	// start a transaction; the scheduler, the waitlist and the approvers get notified after it is committed
+	defer ServeApprovalRequests()
+	defer ServeWaitlists()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+
+	anchor, err := getSeriesAnchor(tx, r.User, r.ID)
+	if err != nil {
+		rollbackTransaction(tx)
+		return err
+	}
+	r.EnvPlainName = anchor.EnvPlainName
+	err = checkRequirements(tx, r)
+	if err != nil {
+		rollbackTransaction(tx)
+		return err
+	}
+
+	shift := r.Start.Sub(anchor.Start)
+	duration := r.End.Sub(r.Start)
+	occurrences := getSeriesReservations(tx, r.User, anchor.SeriesID, notStartedStatuses)
+
+	// first move all occurrences, then check them, so they do not conflict with their own old time ranges
+	problems := []util.SeriesConflict{}
+	for i := range occurrences {
+		o := &occurrences[i]
+		o.Start = o.Start.Add(shift)
+		o.End = o.Start.Add(duration)
+		err = checkTimes(o)
+		if err != nil {
+			problems = append(problems, util.SeriesConflict{Start: o.Start, End: o.End, Reason: reasonOf(err)})
+			continue
+		}
+		_, err = tx.Exec("UPDATE reservations SET start=?, end=?, subject=?, start_mail=?, end_mail=?, delete_on=?, attempts=0, next_retry=NULL WHERE id=?;",
+			o.Start, o.End, r.Subject, r.SendStartMail, r.SendEndMail, addTTL(o.End), o.ID)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+	}
+	for _, o := range occurrences {
+		err = checkConflicts(tx, o.EnvPlainName, o.Start, o.End, o.ID)
+		if err == nil {
+			err = checkQuota(tx, []util.Reservation{o})
+		}
+		if err != nil {
+			problems = append(problems, util.SeriesConflict{Start: o.Start, End: o.End, Reason: reasonOf(err)})
+		}
+	}
+	if len(problems) > 0 {
+		rollbackTransaction(tx)
+		return ReservationError(fmt.Sprintf("%v of %v occurrences are not possible: %v", len(problems), len(occurrences), listConflicts(problems)))
+	}
+
+	for _, o := range occurrences {
+		recordEdit(tx, o, r.User, fmt.Sprintf("series edited; now from %v until %v", o.Start.Format(util.TimeLayout), o.End.Format(util.TimeLayout)))
+	}
+	commitTransaction(tx)
+	logger.Infof("reservation series %v updated: %v occurrences shifted by %v", anchor.SeriesID, len(occurrences), shift)
+	return nil
+}
+
+// AbortReservationSeries aborts all upcoming and pending occurrences of the series which the
+// reservation with the given id belongs to. Occurrences which are already active or over stay
+// untouched.
+func AbortReservationSeries(username string, id int) error {
+	// start a transaction; the scheduler and the waitlist get notified after it is committed
+	defer ServeWaitlists()
+	defer notifyScheduleChanged()
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	anchor, err := getSeriesAnchor(tx, username, id)
+	if err != nil {
+		return err
+	}
+	for _, o := range getSeriesReservations(tx, username, anchor.SeriesID, notStartedStatuses) {
+		err = transition(tx, o.ID, util.StatusAborted, username, "series aborted by user")
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	logger.Infof("reservation series %v aborted by user %v", anchor.SeriesID, username)
+	return nil
+}
+
+// getSeriesAnchor fetches the reservation with the given id and checks, whether it is an upcoming
+// or pending occurrence of a series which belongs to username.
+func getSeriesAnchor(tx *sql.Tx, username string, id int) (util.Reservation, error) {
+	anchor, ok := getUserReservation(tx, username, id)
+	if !ok {
+		logger.Warning(fmt.Errorf("tried to change series of reservation which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
+		return util.Reservation{}, ReservationError("reservation does not exist")
+	}
+	if anchor.SeriesID == 0 {
+		return util.Reservation{}, ReservationError("reservation is not part of a series")
+	}
+	if anchor.Status != util.StatusUpcoming && anchor.Status != util.StatusPending {
+		return util.Reservation{}, ReservationError(fmt.Sprintf("reservation is %v; only upcoming and pending occurrences can be changed", anchor.Status))
+	}
+	return anchor, nil
+}
+
+// getSeriesReservations fetches all occurrences of a series with one of the given statuses,
+// ordered by their start.
+func getSeriesReservations(tx *sql.Tx, username string, seriesID int, statuses []string) []util.Reservation {
+	args := append([]interface{}{username, seriesID}, statusArgs(statuses)...)
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE (username=?) AND (series_id=?) AND (status IN ("+statusPlaceholders(statuses)+")) ORDER BY start;", args...)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	return assembleReservations(rows)
+}
+
+// reasonOf returns the message of a ReservationError without its general prefix.
+func reasonOf(err error) string {
+	if reservationErr, ok := err.(ReservationError); ok {
+		return string(reservationErr)
+	}
+	return err.Error()
+}
+
+// listConflicts describes the first few conflicts in one line for an error message.
+func listConflicts(conflicts []util.SeriesConflict) string {
+	descriptions := []string{}
+	for i, c := range conflicts {
+		if i == maxListedProblems {
+			descriptions = append(descriptions, fmt.Sprintf("and %v more", len(conflicts)-maxListedProblems))
+			break
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%v: %v", c.Start.Format(util.TimeLayout), c.Reason))
+	}
+	return strings.Join(descriptions, "; ")
+}
@@ -0,0 +1,302 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AdvUni/gafaspot/email"
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// waitlistOfferTime is how long a user who was informed about a free time range has priority
+// over users who joined the waitlist later for an overlapping time range.
+const waitlistOfferTime = time.Hour
+
+// waitlistColumns are the columns of table waitlist which are needed to fill a
+// util.WaitlistEntry struct. Use it for every SELECT statement whose result is passed to
+// assembleWaitlist.
+const waitlistColumns = "id, username, env_plain_name, start, end, subject, start_mail, end_mail, created, notified"
+
+// waitlistNotice is a message to a user about a waitlist entry whose time range became free.
+type waitlistNotice struct {
+	entry  util.WaitlistEntry
+	booked bool
+}
+
+// JoinWaitlist puts the user r.User on the waitlist for environment r.EnvPlainName and the time
+// range of r. This is only possible, if a reservation for r would conflict with an existing one;
+// otherwise, the user should create the reservation right away. All other checks are the same
+// as for CreateReservation.
+func JoinWaitlist(r util.Reservation) error {
+	err := checkTimes(&r)
+	if err != nil {
+		return err
+	}
+
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	err = checkRequirements(tx, r)
+	if err != nil {
+		return err
+	}
+	if checkConflicts(tx, r.EnvPlainName, r.Start, r.End, 0) == nil {
+		return ReservationError("the time range is free, so you can create a reservation right away")
+	}
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM waitlist WHERE (username=?) AND (env_plain_name=?) AND (start=?) AND (end=?));", r.User, r.EnvPlainName, r.Start, r.End).Scan(&exists)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	if exists {
+		return ReservationError("you are already on the waitlist for this time range")
+	}
+
+	_, err = tx.Exec("INSERT INTO waitlist (username, env_plain_name, start, end, subject, start_mail, end_mail, created) VALUES(?,?,?,?,?,?,?,?);",
+		r.User, r.EnvPlainName, r.Start, r.End, r.Subject, r.SendStartMail, r.SendEndMail, time.Now())
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	logger.Infof("user %v joined waitlist for environment %v from %v until %v", r.User, r.EnvPlainName, r.Start.Format(util.TimeLayout), r.End.Format(util.TimeLayout))
+	return nil
+}
+
+// LeaveWaitlist removes the waitlist entry with the given id. Only the user who created the entry
+// can remove it.
+func LeaveWaitlist(username string, id int) error {
+	res, err := db.Exec("DELETE FROM waitlist WHERE (username=?) AND (id=?);", username, id)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		logger.Warning(fmt.Errorf("tried to leave waitlist entry which does not exist or not belongs to specified user; id '%v', user '%v'", id, username))
+		return ReservationError("waitlist entry does not exist")
+	}
+	return nil
+}
+
+// GetUserWaitlist returns all waitlist entries of a user, ordered by their start.
+func GetUserWaitlist(username string) []util.WaitlistEntry {
+	rows, err := db.Query("SELECT "+waitlistColumns+" FROM waitlist WHERE username=? ORDER BY start;", username)
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	return assembleWaitlist(rows)
+}
+
+// ServeWaitlists checks for all waitlist entries, whether their time range became free. Entries
+// are served in the order in which users joined the waitlist, so the first eligible user gets the
+// time range. What happens then depends on the environment's waitlist policy: With policy 'book',
+// Gafaspot creates the reservation and removes the entry from the waitlist. With policy 'notify',
+// Gafaspot informs the user, who then has priority for waitlistOfferTime. If the user does not
+// book the time range meanwhile, the entry gets removed and the next user is served. In both
+// cases, the user gets an e-mail if he stored an address.
+// Call ServeWaitlists after each change which may free a time range, and outside of any
+// transaction. Entries whose time range is over get removed.
+func ServeWaitlists() {
+	notices := serveWaitlistEntries(time.Now())
+	if len(notices) == 0 {
+		return
+	}
+
+	// reservations created from the waitlist must be scheduled, and approved if their environment
+	// requires it
+	notifyScheduleChanged()
+	ServeApprovalRequests()
+
+	envs := GetEnvironments()
+	for _, n := range notices {
+		if !email.MailingEnabled {
+			continue
+		}
+		mailAddress, ok := GetUserEmail(n.entry.User)
+		if ok {
+			email.SendWaitlistMail(mailAddress, n.entry, envs[n.entry.EnvPlainName], n.booked)
+		}
+	}
+}
+
+// serveWaitlistEntries does the work of ServeWaitlists within one transaction and returns a
+// notice for each user who has to be informed.
+func serveWaitlistEntries(now time.Time) []waitlistNotice {
+	tx := beginTransaction()
+	defer commitTransaction(tx)
+
+	_, err := tx.Exec("DELETE FROM waitlist WHERE end<=?;", now)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	policies := map[string]string{}
+	rows, err := tx.Query("SELECT env_plain_name, waitlist_policy FROM environments;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	for rows.Next() {
+		var envPlainName, policy string
+		err = rows.Scan(&envPlainName, &policy)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		policies[envPlainName] = policy
+	}
+	rows.Close()
+
+	rows, err = tx.Query("SELECT " + waitlistColumns + " FROM waitlist ORDER BY created, id;")
+	if err != nil {
+		logger.Emergency(err)
+		os.Exit(1)
+	}
+	entries := assembleWaitlist(rows)
+	rows.Close()
+
+	notices := []waitlistNotice{}
+	// offers are the entries which were informed about a free time range recently; they have priority
+	offers := []util.WaitlistEntry{}
+	for _, e := range entries {
+		policy, ok := policies[e.EnvPlainName]
+		if !ok {
+			// environment was removed from config; keep the entry in case it comes back
+			continue
+		}
+		r := util.Reservation{User: e.User, EnvPlainName: e.EnvPlainName, Start: e.Start, End: e.End, Subject: e.Subject, SendStartMail: e.SendStartMail, SendEndMail: e.SendEndMail}
+		if r.Start.Before(now) {
+			// the user still gets the rest of the time range
+			r.Start = now
+		}
+		free := checkConflicts(tx, r.EnvPlainName, r.Start, r.End, 0) == nil
+
+		if !e.Notified.IsZero() {
+			if !free {
+				// someone else booked the time range; inform the user again when it becomes free
+				setWaitlistNotified(tx, e.ID, sql.NullTime{})
+				continue
+			}
+			if now.Sub(e.Notified) < waitlistOfferTime {
+				offers = append(offers, e)
+				continue
+			}
+			// the user did not take the offer, so the next user on the waitlist gets the time range
+			_, err = tx.Exec("DELETE FROM waitlist WHERE id=?;", e.ID)
+			if err != nil {
+				logger.Error(err)
+			}
+			logger.Infof("removed waitlist entry %v of user %v, as the offer to book the free time range expired", e.ID, e.User)
+			continue
+		}
+		if !free || overlapsOffer(e, offers) {
+			continue
+		}
+		err = checkRequirements(tx, r)
+		if err == nil {
+			err = checkQuota(tx, []util.Reservation{r})
+		}
+		if err != nil {
+			logger.Debugf("waitlist entry %v of user %v is not eligible: %v", e.ID, e.User, err)
+			continue
+		}
+
+		if policy == util.WaitlistPolicyBook {
+			_, err = insertReservation(tx, r, "reservation created from waitlist")
+			if err == nil {
+				_, err = tx.Exec("DELETE FROM waitlist WHERE id=?;", e.ID)
+				if err != nil {
+					logger.Error(err)
+				}
+				e.Start = r.Start
+				notices = append(notices, waitlistNotice{entry: e, booked: true})
+				logger.Infof("created reservation from waitlist entry %v for user %v", e.ID, e.User)
+				continue
+			}
+			// offer the time range to the user instead, who may book it by hand
+			logger.Errorf("not able to create reservation from waitlist entry %v: %v", e.ID, err)
+		}
+
+		e.Notified = now
+		setWaitlistNotified(tx, e.ID, sql.NullTime{Time: now, Valid: true})
+		offers = append(offers, e)
+		notices = append(notices, waitlistNotice{entry: e, booked: false})
+		logger.Infof("informed user %v about free time range of waitlist entry %v", e.User, e.ID)
+	}
+	return notices
+}
+
+// removeFulfilledWaitlistEntries removes the waitlist entries of user r.User which are covered
+// by the reservation r, as the user does not need to wait for them anymore.
+func removeFulfilledWaitlistEntries(tx *sql.Tx, r util.Reservation) {
+	_, err := tx.Exec("DELETE FROM waitlist WHERE (username=?) AND (env_plain_name=?) AND (start>=?) AND (end<=?);", r.User, r.EnvPlainName, r.Start, r.End)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func setWaitlistNotified(tx *sql.Tx, id int, notified sql.NullTime) {
+	_, err := tx.Exec("UPDATE waitlist SET notified=? WHERE id=?;", notified, id)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// overlapsOffer determines, whether the time range of e overlaps with the time range of an
+// offered entry for the same environment.
+func overlapsOffer(e util.WaitlistEntry, offers []util.WaitlistEntry) bool {
+	for _, o := range offers {
+		if o.EnvPlainName == e.EnvPlainName && !o.Start.After(e.End) && !o.End.Before(e.Start) {
+			return true
+		}
+	}
+	return false
+}
+
+// assembleWaitlist turns a *Rows element retrieved from the waitlist table into a list of
+// WaitlistEntry elements.
+func assembleWaitlist(rows *sql.Rows) []util.WaitlistEntry {
+	entries := []util.WaitlistEntry{}
+	for rows.Next() {
+		e := util.WaitlistEntry{}
+		var subject sql.NullString
+		var notified sql.NullTime
+		err := rows.Scan(&e.ID, &e.User, &e.EnvPlainName, &e.Start, &e.End, &subject, &e.SendStartMail, &e.SendEndMail, &e.Created, &notified)
+		if err != nil {
+			logger.Emergency(err)
+			os.Exit(1)
+		}
+		if subject.Valid {
+			e.Subject = subject.String
+		}
+		if notified.Valid {
+			e.Notified = notified.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,87 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+)
+
+func TestServeWaitlistEntriesOfferExpiry(t *testing.T) {
+	defer initTestDB(t, util.GafaspotConfig{Environments: map[string]util.EnvironmentConfig{
+		"demo0": {WaitlistPolicy: util.WaitlistPolicyNotify},
+	}})()
+	now := time.Now()
+	start := now.Add(24 * time.Hour).Truncate(time.Hour)
+
+	err := CreateReservation(util.Reservation{User: "owner", EnvPlainName: "demo0", Start: start, End: start.Add(4 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"first", "second"} {
+		err = JoinWaitlist(util.Reservation{User: username, EnvPlainName: "demo0", Start: start.Add(time.Hour), End: start.Add(3 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// free the time range without serving the waitlist right away
+	_, err = db.Exec("UPDATE reservations SET status=? WHERE username=?;", util.StatusAborted, "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		wantNotified []string
+		wantWaiting  []string
+	}{
+		{name: "first user gets the offer", now: now, wantNotified: []string{"first"}, wantWaiting: []string{"first", "second"}},
+		{name: "offer is still valid", now: now.Add(waitlistOfferTime - time.Minute), wantWaiting: []string{"first", "second"}},
+		{name: "offer expired, so the second user gets it", now: now.Add(waitlistOfferTime + time.Minute), wantNotified: []string{"second"}, wantWaiting: []string{"second"}},
+		{name: "offer of the second user is still valid", now: now.Add(waitlistOfferTime + 2*time.Minute), wantWaiting: []string{"second"}},
+	}
+	for _, test := range tests {
+		notified := []string{}
+		for _, n := range serveWaitlistEntries(test.now) {
+			if n.booked {
+				t.Errorf("%v: reservation booked for %v, but policy is notify", test.name, n.entry.User)
+			}
+			notified = append(notified, n.entry.User)
+		}
+		waiting := []string{}
+		for _, username := range []string{"first", "second"} {
+			if len(GetUserWaitlist(username)) > 0 {
+				waiting = append(waiting, username)
+			}
+		}
+		if len(test.wantNotified) == 0 {
+			test.wantNotified = []string{}
+		}
+		if !reflect.DeepEqual(notified, test.wantNotified) {
+			t.Errorf("%v: notified %v, want %v", test.name, notified, test.wantNotified)
+		}
+		if !reflect.DeepEqual(waiting, test.wantWaiting) {
+			t.Errorf("%v: waiting %v, want %v", test.name, waiting, test.wantWaiting)
+		}
+	}
+}
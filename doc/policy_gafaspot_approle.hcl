@@ -4,8 +4,9 @@ path "operate/*" {
 }
 
 # Path store/ holds all KV secrets engines which store credentials from secrets engines at path operate/
+# Gafaspot lists them to find the credentials of co-users of shared reservations
 path "store/*" {
-  capabilities = ["create", "read", "update", "delete"]
+  capabilities = ["create", "read", "update", "delete", "list"]
 }
 
 # Gafaspot uses this path to tune the default and max ttl for leases created by Secrets Engines
@@ -23,3 +24,29 @@ path "auth/token/create-orphan" {
 path "sys/mounts/auth/token/tune" {
   capabilities = ["update"]
 }
+
+# Gafaspot revokes a reservation's orphan token if starting the reservation
+# fails, so that all leases created with it get revoked immediately
+path "auth/token/revoke-self" {
+  capabilities = ["update"]
+}
+
+# Gafaspot revokes a reservation's orphan token by its accessor when the
+# reservation ends
+path "auth/token/revoke-accessor" {
+  capabilities = ["update"]
+}
+
+# Gafaspot revokes the leases of a reservation explicitly when it ends
+path "sys/leases/revoke" {
+  capabilities = ["update"]
+}
+
+# Gafaspot renews a reservation's orphan token and leases when the
+# reservation gets extended
+path "auth/token/renew-accessor" {
+  capabilities = ["update"]
+}
+path "sys/leases/renew" {
+  capabilities = ["update"]
+}
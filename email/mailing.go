@@ -36,6 +36,12 @@ const (
 	// uses when mailing to its users.
 	subjectBeginReservation = "Gafaspot notification: Reservation is active"
 	subjectEndReservation   = "Gafaspot notification: Reservation expired"
+	subjectWaitlistBooked   = "Gafaspot notification: Reservation created from waitlist"
+	subjectWaitlistFree     = "Gafaspot notification: Time range is free"
+	subjectMaintenance      = "Gafaspot notification: Maintenance scheduled"
+	subjectApprovalRequest  = "Gafaspot notification: Reservations wait for approval"
+	subjectApproved         = "Gafaspot notification: Reservation approved"
+	subjectRejected         = "Gafaspot notification: Reservation rejected"
 
 	// msgTemplate is for creating RFC 822-style emails.
 	// Following strings must be passed in the correct order:
@@ -56,8 +62,12 @@ var (
 	mailserver    string
 	senderAddress string
 
-	startmailTmpl *template.Template
-	endmailTmpl   *template.Template
+	startmailTmpl    *template.Template
+	endmailTmpl      *template.Template
+	waitlistmailTmpl *template.Template
+	maintenanceTmpl  *template.Template
+	approvalTmpl     *template.Template
+	decisionTmpl     *template.Template
 )
 
 // InitMailing reads the email paramters from config and stores them as package variables.
@@ -75,8 +85,12 @@ func InitMailing(l logging.Logger, config util.GafaspotConfig) {
 
 	if MailingEnabled {
 		const (
-			startmailTmplFile = "email/templates/startmail.html"
-			endmailTmplFile   = "email/templates/endmail.html"
+			startmailTmplFile    = "email/templates/startmail.html"
+			endmailTmplFile      = "email/templates/endmail.html"
+			waitlistmailTmplFile = "email/templates/waitlistmail.html"
+			maintenanceTmplFile  = "email/templates/maintenancemail.html"
+			approvalTmplFile     = "email/templates/approvalmail.html"
+			decisionTmplFile     = "email/templates/decisionmail.html"
 		)
 		var err error
 		startmailTmpl, err = template.New(path.Base(startmailTmplFile)).Funcs(template.FuncMap{
@@ -91,6 +105,30 @@ func InitMailing(l logging.Logger, config util.GafaspotConfig) {
 		if err != nil {
 			logger.Error(err)
 		}
+		waitlistmailTmpl, err = template.New(path.Base(waitlistmailTmplFile)).Funcs(template.FuncMap{
+			"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+		}).ParseFiles(waitlistmailTmplFile)
+		if err != nil {
+			logger.Error(err)
+		}
+		maintenanceTmpl, err = template.New(path.Base(maintenanceTmplFile)).Funcs(template.FuncMap{
+			"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+		}).ParseFiles(maintenanceTmplFile)
+		if err != nil {
+			logger.Error(err)
+		}
+		approvalTmpl, err = template.New(path.Base(approvalTmplFile)).Funcs(template.FuncMap{
+			"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+		}).ParseFiles(approvalTmplFile)
+		if err != nil {
+			logger.Error(err)
+		}
+		decisionTmpl, err = template.New(path.Base(decisionTmplFile)).Funcs(template.FuncMap{
+			"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+		}).ParseFiles(decisionTmplFile)
+		if err != nil {
+			logger.Error(err)
+		}
 	}
 }
 
@@ -133,3 +171,70 @@ func SendEndReservationMail(recipient string, info util.ReservationCreds) {
 		logger.Errorf("failed to send mail to user %s at end of reservation of env %s: %v", info.Res.User, info.Env.PlainName, err)
 	}
 }
+
+// SendWaitlistMail sends an e-mail to inform a user that the time range of his waitlist entry
+// became free. If booked is true, Gafaspot already created the reservation for him; otherwise,
+// the user can create it himself now. recipient has to be the user's e-mail address.
+func SendWaitlistMail(recipient string, entry util.WaitlistEntry, env util.Environment, booked bool) {
+	var content bytes.Buffer
+	err := waitlistmailTmpl.Execute(&content, map[string]interface{}{"Entry": entry, "Env": env, "Booked": booked})
+	if err != nil {
+		logger.Error(err)
+	}
+	subject := subjectWaitlistFree
+	if booked {
+		subject = subjectWaitlistBooked
+	}
+	err = sendMail(recipient, subject, content.String())
+	if err != nil {
+		logger.Errorf("failed to send waitlist mail to user %s for env %s: %v", entry.User, env.PlainName, err)
+	}
+}
+
+// SendMaintenanceMail sends an e-mail to inform a user that a maintenance window was scheduled,
+// which overlaps with some of his reservations. recipient has to be the user's e-mail address.
+func SendMaintenanceMail(recipient string, window util.MaintenanceWindow, env util.Environment, reservations []util.Reservation) {
+	var content bytes.Buffer
+	err := maintenanceTmpl.Execute(&content, map[string]interface{}{"Window": window, "Env": env, "Reservations": reservations})
+	if err != nil {
+		logger.Error(err)
+	}
+	err = sendMail(recipient, subjectMaintenance, content.String())
+	if err != nil {
+		logger.Errorf("failed to send maintenance mail to user %s for env %s: %v", reservations[0].User, env.PlainName, err)
+	}
+}
+
+// SendApprovalRequestMail sends an e-mail to inform an approver about reservations which wait for
+// approval. envs are all environments by their plain names. recipient has to be the
+// approver's e-mail address.
+func SendApprovalRequestMail(recipient string, reservations []util.Reservation, envs map[string]util.Environment) {
+	var content bytes.Buffer
+	err := approvalTmpl.Execute(&content, map[string]interface{}{"Reservations": reservations, "Envs": envs})
+	if err != nil {
+		logger.Error(err)
+	}
+	err = sendMail(recipient, subjectApprovalRequest, content.String())
+	if err != nil {
+		logger.Errorf("failed to send approval request mail to %s: %v", recipient, err)
+	}
+}
+
+// SendApprovalDecisionMail sends an e-mail to inform a user that a pending reservation got
+// approved or rejected by approver, together with the approver's comment. recipient has to be the
+// user's e-mail address.
+func SendApprovalDecisionMail(recipient string, r util.Reservation, env util.Environment, approved bool, approver, comment string) {
+	var content bytes.Buffer
+	err := decisionTmpl.Execute(&content, map[string]interface{}{"Res": r, "Env": env, "Approved": approved, "Approver": approver, "Comment": comment})
+	if err != nil {
+		logger.Error(err)
+	}
+	subject := subjectRejected
+	if approved {
+		subject = subjectApproved
+	}
+	err = sendMail(recipient, subject, content.String())
+	if err != nil {
+		logger.Errorf("failed to send approval decision mail to user %s for env %s: %v", r.User, env.PlainName, err)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package hooks runs the commands and HTTP callbacks which are configured for an environment
+// before a reservation starts and after it ended, e.g. to reset the environment's VMs.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/AdvUni/gafaspot/util"
+	logging "github.com/alexcesaro/log"
+)
+
+const (
+	// defaultTimeout applies to hooks which do not specify a timeout in config.
+	defaultTimeout = time.Minute
+	// maxOutputLength limits the output of a hook which gets stored with the reservation.
+	maxOutputLength = 1000
+)
+
+var (
+	logger logging.Logger
+
+	// environments maps the plain names of environments to their hooks.
+	environments map[string]util.HooksConfig
+)
+
+// payload is the JSON document which a hook receives about the reservation.
+type payload struct {
+	Stage         string    `json:"stage"`
+	ID            int       `json:"id"`
+	User          string    `json:"user"`
+	Environment   string    `json:"environment"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Subject       string    `json:"subject"`
+	Status        string    `json:"status"`
+	SeriesID      int       `json:"series_id,omitempty"`
+	BundleID      int       `json:"bundle_id,omitempty"`
+	PoolPlainName string    `json:"pool,omitempty"`
+}
+
+// InitHooks initializes the hooks package from gafaspot. Besides setting the logger, it takes
+// over the hooks of all environments from config.
+func InitHooks(l logging.Logger, config util.GafaspotConfig) {
+	logger = l
+
+	environments = make(map[string]util.HooksConfig)
+	for envPlainName, envConf := range config.Environments {
+		environments[util.CreatePlainIdentifier(envPlainName)] = envConf.Hooks
+	}
+}
+
+// Run runs the hooks of the reservation's environment for the given stage, one after another.
+// A failed hook stops the following ones. The function returns one HookResult per hook which ran,
+// so the result is empty if there are no hooks for the stage.
+func Run(stage string, r util.Reservation) []util.HookResult {
+	var hooks []util.HookConfig
+	switch stage {
+	case util.HookBeforeStart:
+		hooks = environments[r.EnvPlainName].BeforeStart
+	case util.HookAfterEnd:
+		hooks = environments[r.EnvPlainName].AfterEnd
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(payload{
+		Stage:         stage,
+		ID:            r.ID,
+		User:          r.User,
+		Environment:   r.EnvPlainName,
+		Start:         r.Start,
+		End:           r.End,
+		Subject:       r.Subject,
+		Status:        r.Status,
+		SeriesID:      r.SeriesID,
+		BundleID:      r.BundleID,
+		PoolPlainName: r.Pool,
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+
+	results := []util.HookResult{}
+	for _, hook := range hooks {
+		result := runHook(hook, input)
+		result.Stage = stage
+		results = append(results, result)
+		if !result.Success {
+			logger.Warningf("%v hook %v failed for reservation with id=%v: %v", stage, result.Hook, r.ID, result.Output)
+			break
+		}
+		logger.Debugf("%v hook %v succeeded for reservation with id=%v", stage, result.Hook, r.ID)
+	}
+	return results
+}
+
+// runHook runs a single hook with input as JSON document and waits for it until its timeout.
+func runHook(hook util.HookConfig, input []byte) util.HookResult {
+	// the timeout was validated when reading the config
+	timeout := defaultTimeout
+	if hook.Timeout != "" {
+		timeout, _ = time.ParseDuration(hook.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := util.HookResult{Time: time.Now()}
+	var output []byte
+	var err error
+	if hook.URL != "" {
+		result.Hook = hook.URL
+		output, err = post(ctx, hook.URL, input)
+	} else {
+		result.Hook = strings.Join(hook.Command, " ")
+		cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(input)
+		output, err = cmd.CombinedOutput()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+
+	result.Success = err == nil
+	result.Output = strings.TrimSpace(string(output))
+	if err != nil && result.Output != "" {
+		result.Output = fmt.Sprintf("%v; %v", err, result.Output)
+	} else if err != nil {
+		result.Output = err.Error()
+	}
+	if len(result.Output) > maxOutputLength {
+		result.Output = result.Output[:maxOutputLength] + "..."
+	}
+	return result
+}
+
+// post sends input to url and returns the response body. Responses with a status other than 2xx
+// are errors.
+func post(ctx context.Context, url string, input []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return body, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("callback returned status %v", resp.Status)
+	}
+	return body, nil
+}
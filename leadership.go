@@ -0,0 +1,94 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/AdvUni/gafaspot/database"
+	logging "github.com/alexcesaro/log"
+)
+
+// handleLeadership makes sure that only one of several Gafaspot instances sharing the same
+// database scans reservations. It competes for the leader lease in database, and only while this
+// instance holds the lease, it runs handleReservationScanning. The lease gets renewed regularly.
+// If the leader dies, its lease expires and another instance takes over automatically. If this
+// instance loses the lease, it stops scanning after the running scan is finished.
+// The function returns as soon as ctx is done, after releasing the lease.
+func handleLeadership(ctx context.Context, l logging.Logger, instance, leaseString, intervalString string) {
+	logger = l
+
+	lease, err := time.ParseDuration(leaseString)
+	if err != nil {
+		logger.Emergencyf("invalid time string in config for leader-lease-duration: %v", err)
+		os.Exit(1)
+	}
+	// renew the lease several times per lease duration, so a single slow renewal does not lose it
+	renewal := lease / 3
+
+	tick := time.NewTicker(renewal)
+	defer tick.Stop()
+	for {
+		if database.AcquireLeadership(instance, time.Now(), lease) {
+			logger.Infof("instance '%v' is leader now and scans reservations", instance)
+			leadReservationScanning(ctx, instance, lease, tick.C, intervalString)
+			if ctx.Err() != nil {
+				database.ReleaseLeadership(instance)
+				return
+			}
+			logger.Warningf("instance '%v' lost the leader lease and stopped scanning reservations", instance)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// leadReservationScanning runs handleReservationScanning and renews the leader lease on each
+// tick. It returns when ctx is done or when the lease could not be renewed. In both cases, it
+// waits for handleReservationScanning to return, so a running scan is finished first. Another
+// instance may already have taken over meanwhile. It leaves the reservations this instance
+// claimed alone as long as this instance renews its instance lease, which happens together with
+// the leader lease. If this instance was considered dead nevertheless, e.g. because the process
+// was paused, the scan does not record outcomes for reservations it does not hold anymore.
+func leadReservationScanning(ctx context.Context, instance string, lease time.Duration, tick <-chan time.Time, intervalString string) {
+	leaderCtx, stopScanning := context.WithCancel(ctx)
+	defer stopScanning()
+	scanningDone := make(chan struct{})
+	go func() {
+		defer close(scanningDone)
+		handleReservationScanning(leaderCtx, logger, intervalString)
+	}()
+
+	for {
+		select {
+		case <-scanningDone:
+			return
+		case <-tick:
+			if !database.AcquireLeadership(instance, time.Now(), lease) {
+				stopScanning()
+			}
+		}
+	}
+}
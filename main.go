@@ -19,18 +19,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alexcesaro/log/stdlog"
 
 	"github.com/AdvUni/gafaspot/database"
 	"github.com/AdvUni/gafaspot/email"
+	"github.com/AdvUni/gafaspot/hooks"
 	"github.com/AdvUni/gafaspot/ui"
 	"github.com/AdvUni/gafaspot/vault"
 	"github.com/hashicorp/vault/sdk/helper/mlock"
 )
 
+// shutdownTimeout is the time the web server gets at shutdown to finish running requests.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// get config command line parameter and init logger
 	configFile := flag.String("config", "", "set config file explicitly. Per default, Gafaspot searches for config at './gafaspot_config.yaml'")
@@ -63,12 +72,46 @@ func main() {
 	// do initialization with config values
 	logger.Info("Initialization...")
 	vault.InitVaultParams(logger, config)
-	database.InitDB(logger, config)
+	// mailing is initialized first, as the database informs users about new maintenance windows
 	email.InitMailing(logger, config)
+	database.InitDB(logger, config)
+	hooks.InitHooks(logger, config)
 
-	// start webserver and routine for processing reservations
+	// listen for termination signals already, so they are not missed during startup
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	// start webserver and routine for processing reservations; if several Gafaspot instances share
+	// the database, only the leader among them processes reservations
 	logger.Info("Starting reservation scanning routine...")
-	go handleReservationScanning(logger, config.ScanningInterval)
+	ui.SetInstanceName(config.InstanceName)
+	ui.SetAdminPolicy(config.AdminPolicy)
+	ctx, stopScanning := context.WithCancel(context.Background())
+	var scanning sync.WaitGroup
+	scanning.Add(1)
+	go func() {
+		defer scanning.Done()
+		handleLeadership(ctx, logger, config.InstanceName, config.LeaderLease, config.ScanningInterval)
+	}()
 	logger.Info("Starting web server...")
-	ui.RunWebserver(logger, config.WebserviceAddress)
+	go ui.RunWebserver(logger, config.WebserviceAddress)
+
+	// wait for termination
+	sig := <-signals
+	logger.Infof("Received signal %v, shutting down...", sig)
+
+	// stop accepting http requests and let running ones finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := ui.ShutdownWebserver(shutdownCtx)
+	if err != nil {
+		logger.Errorf("failed to shut down web server gracefully: %v", err)
+	}
+
+	// let a running reservation scan finish its work in Vault and record the outcome in database
+	stopScanning()
+	scanning.Wait()
+
+	database.CloseDB()
+	logger.Info("Goodbye!")
 }
@@ -19,10 +19,14 @@
 package main
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"github.com/AdvUni/gafaspot/database"
+	"github.com/AdvUni/gafaspot/hooks"
+	"github.com/AdvUni/gafaspot/ui"
+	"github.com/AdvUni/gafaspot/util"
 	"github.com/AdvUni/gafaspot/vault"
 	logging "github.com/alexcesaro/log"
 )
@@ -31,9 +35,25 @@ var (
 	logger logging.Logger
 )
 
-// handleReservationScanning is an endless loop which repetitively calls reservationScan. This is
-// keeping the reservations table in database up-to-date.
-func handleReservationScanning(l logging.Logger, intervalString string) {
+// minSchedulerDelay is the minimum time the scheduler waits before it performs the next
+// reservation scan on its own. This keeps it from spinning if a reservation stays due for some
+// reason.
+const minSchedulerDelay = time.Second
+
+// rescheduleInterval is the time after which the scheduler determines the next reservation scan
+// anew, even if it was not notified about changed reservations. This is needed because other
+// Gafaspot instances sharing the database may create or abort reservations, too.
+const rescheduleInterval = 15 * time.Second
+
+// handleReservationScanning is an endless loop which calls reservationScan exactly when the next
+// reservation needs to be started or ended. This is keeping the reservations table in database
+// up-to-date. Whenever reservations get created or aborted, the time of the next scan gets
+// determined anew. Right at startup, it performs a scan to catch up on everything which was missed
+// while Gafaspot was not running. Additionally, it scans all reservations each scanning interval
+// as a safety net, e.g. for deleting old entries.
+// The loop returns as soon as ctx is done. A reservation scan which is running at this point is
+// finished before, so no booking gets started or ended in Vault without being recorded in database.
+func handleReservationScanning(ctx context.Context, l logging.Logger, intervalString string) {
 	logger = l
 
 	scanningInterval, err := time.ParseDuration(intervalString)
@@ -42,30 +62,130 @@ func handleReservationScanning(l logging.Logger, intervalString string) {
 		os.Exit(1)
 	}
 
-	// endless loop, triggered each 5 minutes
-	tick := time.NewTicker(scanningInterval).C
-	for {
-		<-tick
-		reservationScan()
-		logger.Debug("executed reservation scan")
+	// catch up on missed starts and ends
+	reservationScan()
+	logger.Debug("executed reservation scan at startup")
+
+	// repair what the scan can not: differences between database and Vault left by a crash
+	database.TakeReconciliationRequests()
+	reconciliation()
+
+	// endless loop, triggered by the next due reservation or each scanning interval
+	tick := time.NewTicker(scanningInterval)
+	defer tick.Stop()
+	reschedule := time.NewTicker(rescheduleInterval)
+	defer reschedule.Stop()
+	for ctx.Err() == nil {
+		timer, timerC := armScheduler()
+		select {
+		case <-ctx.Done():
+			logger.Info("reservation scanning stopped")
+		case <-timerC:
+			reservationScan()
+			logger.Debug("executed scheduled reservation scan")
+		case <-tick.C:
+			reservationScan()
+			logger.Debug("executed periodic reservation scan")
+		case <-database.ScheduleChanged():
+			logger.Debug("reservations changed, rescheduling")
+		case <-database.ReconciliationRequested():
+			if database.TakeReconciliationRequests() {
+				reconciliation()
+			}
+		case <-reschedule.C:
+			// reconciliations may also be requested through other Gafaspot instances
+			if database.TakeReconciliationRequests() {
+				reconciliation()
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
 
+// armScheduler creates a timer which fires when the next reservation needs to be started or
+// ended. If there is no such reservation, the returned timer and channel are nil; receiving from
+// the nil channel blocks forever.
+func armScheduler() (*time.Timer, <-chan time.Time) {
+	next, ok := database.NextTransitionTime()
+	if !ok {
+		return nil, nil
+	}
+	delay := time.Until(next)
+	if delay < minSchedulerDelay {
+		delay = minSchedulerDelay
+	}
+	logger.Debugf("next reservation scan scheduled for %v", time.Now().Add(delay).Format(util.TimeLayout))
+	timer := time.NewTimer(delay)
+	return timer, timer.C
+}
+
 // reservationScan reads through all reservations in database and checks if there must be performed
-// an action as starting or ending them.
+// an action as starting or ending them. Each reservation is handled on its own, so one problematic
+// reservation does not hold up the others. All outcomes are gathered into a scan report, which
+// gets logged and passed to the web server for display.
 func reservationScan() {
 
 	now := time.Now()
+	report := util.ScanReport{Time: now}
+
+	// any reservations which were interrupted while starting or ending? the scan repeats them
+	database.ResetInterruptedTransitions(now)
 
 	// any active bookings which should end?
-	database.ExpireActiveReservations(now, vault.EndBooking)
+	report.Outcomes = append(report.Outcomes, database.ExpireActiveReservations(now, vault.EndBooking, hooks.Run)...)
+
+	// any pool reservations whose environment became unavailable?
+	database.ReassignPoolReservations()
+
+	// any pending bookings which nobody approved before their start?
+	database.RejectOverduePendingReservations(now)
 
 	// any upcoming bookings which should start?
-	database.StartUpcomingReservations(now, vault.StartBooking, vault.ReadCredentials)
+	report.Outcomes = append(report.Outcomes, database.StartUpcomingReservations(now, vault.StartBooking, vault.EndBooking, vault.ReadCredentials, hooks.Run)...)
+
+	// any time ranges which became free for users on a waitlist?
+	database.ServeWaitlists()
+
+	// any pending bookings the approvers do not know about yet?
+	database.ServeApprovalRequests()
 
 	// any expired bookings which should get deleted?
 	database.DeleteOldReservations(now)
 
 	// finally, check if some of the entries in users table reached deletion_date
 	database.DeleteOldUserEntries(now)
+
+	logScanReport(report)
+	ui.SetScanReport(report)
+}
+
+// reconciliation compares the reservations in database with the credentials stored in Vault and
+// repairs inconsistencies where possible. The report gets logged and passed to the web server for
+// display.
+func reconciliation() {
+	report := database.ReconcileReservations(time.Now(), vault.InspectStoredCredentials, vault.EndBooking)
+
+	unresolved := report.Unresolved()
+	if len(unresolved) > 0 {
+		logger.Warningf("reconciliation checked %v environments and found %v inconsistencies, %v of them unresolved", report.Environments, len(report.Findings), len(unresolved))
+	} else {
+		logger.Infof("reconciliation checked %v environments and found %v inconsistencies, all of them resolved", report.Environments, len(report.Findings))
+	}
+	ui.SetReconciliationReport(report)
+}
+
+// logScanReport writes a summary of a scan report to the log. The single outcomes are already
+// logged while the reservations are processed.
+func logScanReport(report util.ScanReport) {
+	if len(report.Outcomes) == 0 {
+		return
+	}
+	problems := report.Problems()
+	if len(problems) > 0 {
+		logger.Warningf("reservation scan handled %v reservations, %v of them with problems", len(report.Outcomes), len(problems))
+	} else {
+		logger.Infof("reservation scan handled %v reservations without problems", len(report.Outcomes))
+	}
 }
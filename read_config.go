@@ -19,6 +19,7 @@
 package main
 
 import (
+	"fmt"
 	"net/mail"
 	"os"
 	"time"
@@ -33,6 +34,10 @@ var (
 		"webservice-address":            "0.0.0.0:80",
 		"gafaspot-mailaddress":          "gafaspot@gafaspot.com",
 		"scanning-interval":             "5m",
+		"retry-max-attempts":            5,
+		"retry-backoff":                 "1m",
+		"max-parallel-operations":       4,
+		"leader-lease-duration":         "30s",
 		"max-reservation-duration-days": 30,
 		"max-queuing-time-months":       2,
 		"db-path":                       "./gafaspot.db",
@@ -88,6 +93,160 @@ func readConfig(logger logging.Logger, configFile string) util.GafaspotConfig {
 		os.Exit(1)
 	}
 	logger.Debugf("scanning interval is: %v", scanningInterval)
+	if config.RetryMaxAttempts < 1 {
+		logger.Emergencyf("invalid value in config for retry-max-attempts: %v; must be at least 1", config.RetryMaxAttempts)
+		os.Exit(1)
+	}
+	retryBackoff, err := time.ParseDuration(config.RetryBackoff)
+	if err != nil {
+		logger.Emergencyf("invalid time string in config for retry-backoff: %v", err)
+		os.Exit(1)
+	}
+	if retryBackoff <= 0 {
+		logger.Emergencyf("invalid value in config for retry-backoff: %v; must be positive", retryBackoff)
+		os.Exit(1)
+	}
+	if config.MaxParallel < 1 {
+		logger.Emergencyf("invalid value in config for max-parallel-operations: %v; must be at least 1", config.MaxParallel)
+		os.Exit(1)
+	}
+	leaderLease, err := time.ParseDuration(config.LeaderLease)
+	if err != nil {
+		logger.Emergencyf("invalid time string in config for leader-lease-duration: %v", err)
+		os.Exit(1)
+	}
+	if leaderLease < 3*time.Second {
+		logger.Emergencyf("invalid value in config for leader-lease-duration: %v; must be at least 3s", leaderLease)
+		os.Exit(1)
+	}
+
+	// each environment has a waitlist policy, which defaults to notify
+	for name, envConf := range config.Environments {
+		switch envConf.WaitlistPolicy {
+		case "":
+			envConf.WaitlistPolicy = util.WaitlistPolicyNotify
+			config.Environments[name] = envConf
+		case util.WaitlistPolicyNotify, util.WaitlistPolicyBook:
+		default:
+			logger.Emergencyf("invalid value in config for waitlist-policy of environment %v: %v; must be %v or %v", name, envConf.WaitlistPolicy, util.WaitlistPolicyNotify, util.WaitlistPolicyBook)
+			os.Exit(1)
+		}
+	}
+
+	// the cleanup buffer is a duration and defaults to none
+	for name, envConf := range config.Environments {
+		if envConf.CleanupBuffer == "" {
+			continue
+		}
+		buffer, err := time.ParseDuration(envConf.CleanupBuffer)
+		if err != nil {
+			logger.Emergencyf("invalid time string in config for cleanup-buffer of environment %v: %v", name, err)
+			os.Exit(1)
+		}
+		if buffer < 0 {
+			logger.Emergencyf("invalid value in config for cleanup-buffer of environment %v: %v; must not be negative", name, buffer)
+			os.Exit(1)
+		}
+	}
+
+	// each hook is either a command or an URL and may have a timeout
+	for name, envConf := range config.Environments {
+		hooks := append(append([]util.HookConfig{}, envConf.Hooks.BeforeStart...), envConf.Hooks.AfterEnd...)
+		for _, hook := range hooks {
+			if (len(hook.Command) == 0) == (hook.URL == "") {
+				logger.Emergencyf("invalid hook for environment %v: give either a command or an url", name)
+				os.Exit(1)
+			}
+			if hook.Timeout == "" {
+				continue
+			}
+			timeout, err := time.ParseDuration(hook.Timeout)
+			if err != nil || timeout <= 0 {
+				logger.Emergencyf("invalid timeout of hook for environment %v: %v; must be a positive duration", name, hook.Timeout)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// environments which require approval need approvers, who default to the admins
+	for name, envConf := range config.Environments {
+		if !envConf.RequiresApproval || envConf.ApproverPolicy != "" {
+			continue
+		}
+		if config.AdminPolicy == "" {
+			logger.Emergencyf("invalid config for environment %v: requires-approval needs approver-policy or admin-policy", name)
+			os.Exit(1)
+		}
+		envConf.ApproverPolicy = config.AdminPolicy
+		config.Environments[name] = envConf
+	}
+
+	// maintenance windows must have valid times in the right order
+	for name, envConf := range config.Environments {
+		for _, m := range envConf.Maintenance {
+			start, err := time.ParseInLocation(util.TimeLayout, m.Start, time.Local)
+			if err != nil {
+				logger.Emergencyf("invalid start of maintenance window for environment %v: %v; must have format %v", name, m.Start, util.TimeLayout)
+				os.Exit(1)
+			}
+			end, err := time.ParseInLocation(util.TimeLayout, m.End, time.Local)
+			if err != nil {
+				logger.Emergencyf("invalid end of maintenance window for environment %v: %v; must have format %v", name, m.End, util.TimeLayout)
+				os.Exit(1)
+			}
+			if !start.Before(end) {
+				logger.Emergencyf("invalid maintenance window for environment %v: start %v is not before end %v", name, m.Start, m.End)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// pools consist of configured environments and must not be named like one
+	for name, poolConf := range config.Pools {
+		if _, ok := config.Environments[name]; ok {
+			logger.Emergencyf("invalid config for pool %v: there is an environment with the same name", name)
+			os.Exit(1)
+		}
+		if len(poolConf.Environments) == 0 {
+			logger.Emergencyf("invalid config for pool %v: pool has no environments", name)
+			os.Exit(1)
+		}
+		for _, member := range poolConf.Environments {
+			if _, ok := config.Environments[member]; !ok {
+				logger.Emergencyf("invalid config for pool %v: environment %v does not exist", name, member)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// a limit for booked hours needs a time window to refer to
+	checkQuota := func(name string, q util.QuotaConfig) {
+		if q.MaxConcurrent < 0 || q.MaxUpcoming < 0 || q.MaxHours < 0 || q.WindowDays < 0 {
+			logger.Emergencyf("invalid config for quota %v: values must not be negative", name)
+			os.Exit(1)
+		}
+		if q.MaxHours > 0 && q.WindowDays == 0 {
+			logger.Emergencyf("invalid config for quota %v: max-booked-hours needs booked-hours-window-days", name)
+			os.Exit(1)
+		}
+	}
+	checkQuota("default", config.Quotas.Default)
+	for name, q := range config.Quotas.Users {
+		checkQuota("of user "+name, q)
+	}
+	for name, q := range config.Quotas.Groups {
+		checkQuota("of group "+name, q)
+	}
+
+	// every Gafaspot instance sharing the database needs an unique name
+	if config.InstanceName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "gafaspot"
+		}
+		config.InstanceName = fmt.Sprintf("%v-%v", hostname, os.Getpid())
+	}
+	logger.Debugf("instance name is: %v", config.InstanceName)
 
 	return config
 }
@@ -0,0 +1,102 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/AdvUni/gafaspot/database"
+)
+
+func approvalsPageHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	errormessage := readErrorCookie(w, r)
+	infomessage := readInfoCookie(w, r)
+
+	pending := []reservationNiceName{}
+	for _, res := range database.GetPendingApprovals(username) {
+		pending = append(pending, newReservationNiceName(res))
+	}
+
+	err := approvalsTmpl.Execute(w, map[string]interface{}{
+		"Username": username,
+		"Error":    errormessage,
+		"Info":     infomessage,
+		"Pending":  pending,
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func approvereservationHandler(w http.ResponseWriter, r *http.Request) {
+	decideHandler(w, r, true)
+}
+
+func rejectreservationHandler(w http.ResponseWriter, r *http.Request) {
+	decideHandler(w, r, false)
+}
+
+// decideHandler approves or rejects the pending reservation given in the request's form.
+func decideHandler(w http.ResponseWriter, r *http.Request, approve bool) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameters from approval request: %v\n", err)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("approval request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+	comment := template.HTMLEscapeString(r.Form.Get("comment"))
+
+	if approve {
+		err = database.ApproveReservation(username, reservationID, comment)
+	} else {
+		if comment == "" {
+			redirectInvalidSubmission(w, r, "please explain with a comment why you reject the reservation")
+			return
+		}
+		err = database.RejectReservation(username, reservationID, comment)
+	}
+	if err != nil {
+		logger.Debugf("approval handler could not decide on reservation: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	if approve {
+		setInfoCookie(w, "Reservation approved")
+	} else {
+		setInfoCookie(w, "Reservation rejected")
+	}
+	http.Redirect(w, r, approvals, http.StatusSeeOther)
+}
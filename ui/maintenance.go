@@ -0,0 +1,173 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdvUni/gafaspot/database"
+	"github.com/AdvUni/gafaspot/util"
+)
+
+// adminPolicy is the Vault policy which marks a user as admin. Only admins may add or delete
+// maintenance windows at runtime. If it is empty, there are no admins.
+var adminPolicy string
+
+// maintenanceNiceName extends a maintenance window by the nice name of its environment.
+type maintenanceNiceName struct {
+	util.MaintenanceWindow
+	EnvNiceName string
+}
+
+// SetAdminPolicy tells the web interface which Vault policy marks a user as admin. Call it before
+// starting the web server.
+func SetAdminPolicy(policy string) {
+	adminPolicy = policy
+}
+
+// isAdmin checks whether the user got the admin policy from Vault at his last login.
+func isAdmin(username string) bool {
+	return adminPolicy != "" && database.UserHasGroup(username, adminPolicy)
+}
+
+// groupMaintenance sorts the maintenance windows by environment.
+func groupMaintenance(windows []util.MaintenanceWindow) map[string][]util.MaintenanceWindow {
+	byEnv := map[string][]util.MaintenanceWindow{}
+	for _, w := range windows {
+		byEnv[w.EnvPlainName] = append(byEnv[w.EnvPlainName], w)
+	}
+	return byEnv
+}
+
+func maintenancePageHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	errormessage := readErrorCookie(w, r)
+	infomessage := readInfoCookie(w, r)
+
+	var windows []maintenanceNiceName
+	for _, m := range database.GetMaintenanceWindows() {
+		windows = append(windows, maintenanceNiceName{m, environmentsMap[m.EnvPlainName].NiceName})
+	}
+
+	err := maintenanceTmpl.Execute(w, map[string]interface{}{
+		"Username": username,
+		"Error":    errormessage,
+		"Info":     infomessage,
+		"IsAdmin":  isAdmin(username),
+		"Envs":     environments,
+		"Windows":  windows,
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func addmaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	if !isAdmin(username) {
+		logger.Warningf("user %v tried to add a maintenance window without being admin", username)
+		redirectInvalidSubmission(w, r, "only admins can add maintenance windows")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameters from add maintenance request: %v\n", err)
+		return
+	}
+
+	window := util.MaintenanceWindow{
+		EnvPlainName: template.HTMLEscapeString(r.Form.Get("env")),
+		Reason:       template.HTMLEscapeString(r.Form.Get("reason")),
+		Creator:      username,
+	}
+
+	// get start from form
+	startdateStr := template.HTMLEscapeString(r.Form.Get("startdate"))
+	starttimeStr := template.HTMLEscapeString(r.Form.Get("starttime"))
+	window.Start, err = time.ParseInLocation(util.TimeLayout, startdateStr+" "+starttimeStr, time.Local)
+	if err != nil {
+		logger.Debugf("add maintenance handler received malformed date/time submission: %v", err)
+		redirectInvalidSubmission(w, r, "start date/time malformed")
+		return
+	}
+
+	// get end from form
+	enddateStr := template.HTMLEscapeString(r.Form.Get("enddate"))
+	endtimeStr := template.HTMLEscapeString(r.Form.Get("endtime"))
+	window.End, err = time.ParseInLocation(util.TimeLayout, enddateStr+" "+endtimeStr, time.Local)
+	if err != nil {
+		logger.Debugf("add maintenance handler received malformed date/time submission: %v", err)
+		redirectInvalidSubmission(w, r, "end date/time malformed")
+		return
+	}
+
+	affected, err := database.AddMaintenanceWindow(window)
+	if err != nil {
+		logger.Debugf("add maintenance handler could not add maintenance window: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, fmt.Sprintf("Maintenance window added; the owners of %v affected reservation(s) were informed", affected))
+	http.Redirect(w, r, maintenance, http.StatusSeeOther)
+}
+
+func deletemaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	if !isAdmin(username) {
+		logger.Warningf("user %v tried to delete a maintenance window without being admin", username)
+		redirectInvalidSubmission(w, r, "only admins can delete maintenance windows")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameter id from delete maintenance request: %v\n", err)
+		return
+	}
+
+	windowID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("deletemaintenance request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	err = database.DeleteMaintenanceWindow(windowID, username)
+	if err != nil {
+		logger.Debugf("delete maintenance handler could not delete maintenance window: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "Maintenance window deleted")
+	http.Redirect(w, r, maintenance, http.StatusSeeOther)
+}
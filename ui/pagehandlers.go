@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"net/mail"
 	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -39,19 +40,45 @@ import (
 type envReservations struct {
 	Env          util.Environment
 	Reservations []util.Reservation
+	Maintenance  []util.MaintenanceWindow
+}
+
+// waitlistEntryNiceName is a struct used for passing waitlist entries to personal view
+type waitlistEntryNiceName struct {
+	util.WaitlistEntry
+	EnvNiceName    string
+	WaitlistPolicy string
 }
 
 // reservationNiceName is a struct used for passing reservation data to personal view
 type reservationNiceName struct {
-	EnvNiceName  string
-	ID           int
-	Status       string
-	User         string
-	EnvPlainName string
-	Start        time.Time
-	End          time.Time
-	Subject      string
-	Labels       string
+	EnvNiceName   string
+	ID            int
+	Status        string
+	User          string
+	EnvPlainName  string
+	Start         time.Time
+	End           time.Time
+	Subject       string
+	Labels        string
+	SendStartMail bool
+	SendEndMail   bool
+	SeriesID      int
+	Pool          string
+	BundleID      int
+	ErrorDetail   string
+	CoUsers       []string
+	Events        []util.ReservationEvent
+	// Members lists all reservations of a bundle, including this one. It is only filled for the
+	// first reservation of a bundle, which represents the whole bundle in personal view.
+	Members []reservationNiceName
+}
+
+// credsGroup is a struct used for passing credentials to creds view. The credentials of all
+// reservations of a bundle are shown together; BundleID is zero for single reservations.
+type credsGroup struct {
+	BundleID int
+	Creds    []util.ReservationCreds
 }
 
 func newReservationNiceName(r util.Reservation) reservationNiceName {
@@ -65,7 +92,60 @@ func newReservationNiceName(r util.Reservation) reservationNiceName {
 		r.End,
 		r.Subject,
 		r.Labels,
+		r.SendStartMail,
+		r.SendEndMail,
+		r.SeriesID,
+		r.Pool,
+		r.BundleID,
+		r.ErrorDetail,
+		r.CoUsers,
+		nil,
+		nil,
+	}
+}
+
+// groupBundles merges the reservations of each bundle into one reservationNiceName, which takes
+// the place of the bundle's first reservation. It lists the environments of all reservations in
+// its EnvNiceName, their single reservations in Members and the events of all of them.
+func groupBundles(reservations []reservationNiceName) []reservationNiceName {
+	grouped := []reservationNiceName{}
+	bundleIndex := map[int]int{}
+	for _, r := range reservations {
+		if r.BundleID == 0 {
+			grouped = append(grouped, r)
+			continue
+		}
+		i, ok := bundleIndex[r.BundleID]
+		if !ok {
+			bundleIndex[r.BundleID] = len(grouped)
+			group := r
+			group.Members = []reservationNiceName{r}
+			group.ErrorDetail = ""
+			group.Events = labelEvents(r)
+			grouped = append(grouped, group)
+			continue
+		}
+		grouped[i].EnvNiceName += " + " + r.EnvNiceName
+		grouped[i].Members = append(grouped[i].Members, r)
+		grouped[i].Events = append(grouped[i].Events, labelEvents(r)...)
+	}
+	for _, g := range grouped {
+		sort.SliceStable(g.Events, func(i, j int) bool {
+			return g.Events[i].Time.Before(g.Events[j].Time)
+		})
 	}
+	return grouped
+}
+
+// labelEvents returns the events of reservation r with its environment prepended to each reason,
+// so the events of a bundle's reservations can be told apart.
+func labelEvents(r reservationNiceName) []util.ReservationEvent {
+	labeled := []util.ReservationEvent{}
+	for _, e := range r.Events {
+		e.Reason = r.EnvNiceName + ": " + e.Reason
+		labeled = append(labeled, e)
+	}
+	return labeled
 }
 
 func loginPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -85,6 +165,7 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var envReservationsList []envReservations
+	maintenance := groupMaintenance(database.GetMaintenanceWindows())
 
 	for _, env := range environments {
 
@@ -94,10 +175,10 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 			return reservations[i].Start.Before(reservations[j].Start)
 		})
 
-		envReservationsList = append(envReservationsList, envReservations{env, reservations})
+		envReservationsList = append(envReservationsList, envReservations{env, reservations, maintenance[env.PlainName]})
 	}
 
-	err := mainviewTmpl.Execute(w, map[string]interface{}{"Username": username, "Envcontent": envReservationsList})
+	err := mainviewTmpl.Execute(w, map[string]interface{}{"Username": username, "Envcontent": envReservationsList, "Pools": pools})
 	if err != nil {
 		logger.Error(err)
 	}
@@ -125,17 +206,32 @@ func personalPageHandler(w http.ResponseWriter, r *http.Request) {
 	sort.Slice(reservations, func(i, j int) bool {
 		return reservations[i].Start.Before(reservations[j].Start)
 	})
+	events := database.GetUserReservationEvents(username)
 	var resNice []reservationNiceName
 	for _, r := range reservations {
-		resNice = append(resNice, newReservationNiceName(r))
+		rn := newReservationNiceName(r)
+		rn.Events = events[r.ID]
+		resNice = append(resNice, rn)
+	}
+	resNice = groupBundles(resNice)
+	var waitlistNice []waitlistEntryNiceName
+	for _, e := range database.GetUserWaitlist(username) {
+		env := environmentsMap[e.EnvPlainName]
+		waitlistNice = append(waitlistNice, waitlistEntryNiceName{e, env.NiceName, env.WaitlistPolicy})
 	}
 
+	errormessage := readErrorCookie(w, r)
+	infomessage := readInfoCookie(w, r)
+
 	err := personalviewTmpl.Execute(w, map[string]interface{}{
+		"Error":         errormessage,
+		"Info":          infomessage,
 		"Username":      username,
 		"SSHkey":        sshEntry,
 		"EmailDisabled": !email.MailingEnabled,
 		"Email":         mail,
 		"Reservations":  resNice,
+		"Waitlist":      waitlistNice,
 	})
 	if err != nil {
 		logger.Error(err)
@@ -150,7 +246,20 @@ func credsPageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	credsData := database.CollectUserCreds(username, vault.ReadCredentials)
 
-	credsviewTmpl.Execute(w, map[string]interface{}{"Username": username, "CredsData": credsData})
+	// credentials of a bundle's reservations are shown together
+	var groups []credsGroup
+	bundleIndex := map[int]int{}
+	for _, c := range credsData {
+		i, ok := bundleIndex[c.Res.BundleID]
+		if c.Res.BundleID == 0 || !ok {
+			bundleIndex[c.Res.BundleID] = len(groups)
+			groups = append(groups, credsGroup{c.Res.BundleID, []util.ReservationCreds{c}})
+			continue
+		}
+		groups[i].Creds = append(groups[i].Creds, c)
+	}
+
+	credsviewTmpl.Execute(w, map[string]interface{}{"Username": username, "CredsData": groups})
 }
 
 func newreservationPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -163,19 +272,27 @@ func newreservationPageHandler(w http.ResponseWriter, r *http.Request) {
 	errormessage := readErrorCookie(w, r)
 	cookieFormData := readReservationFormCookies(w, r)
 
+	// the url may name an environment or a pool
 	selectedEnvPlainName := mux.Vars(r)["env"]
-	env, ok := environmentsMap[selectedEnvPlainName]
-	if !ok {
+	var hasSSH, isPool bool
+	if env, ok := environmentsMap[selectedEnvPlainName]; ok {
+		hasSSH = env.HasSSH
+	} else if pool, ok := poolsMap[selectedEnvPlainName]; ok {
+		hasSSH = pool.HasSSH
+		isPool = true
+	} else {
 		fmt.Fprint(w, "environment in url does not exist")
 		return
 	}
-	sshMissing := env.HasSSH && !database.UserHasSSH(username)
+	sshMissing := hasSSH && !database.UserHasSSH(username)
 	emailMissing := !database.UserHasEmail(username)
 
 	err := reservationformTmpl.Execute(w, map[string]interface{}{
 		"Username":      username,
 		"Envs":          environments,
+		"Pools":         pools,
 		"Selected":      selectedEnvPlainName,
+		"IsPool":        isPool,
 		"SSHmissing":    sshMissing,
 		"EmailDisabled": !email.MailingEnabled,
 		"EmailMissing":  emailMissing,
@@ -205,16 +322,126 @@ func reserveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservation, formData, err := reservationFromForm(r, username)
+	if err != nil {
+		logger.Debugf("reserve handler received invalid submission: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+
+	// a reservation for a pool gets assigned to one of the pool's environments
+	if _, ok := poolsMap[reservation.EnvPlainName]; ok {
+		if r.Form.Get("repeat") != "" && r.Form.Get("repeat") != "none" {
+			setReservationFormCookies(w, formData)
+			redirectInvalidSubmission(w, r, "recurring reservations are not possible for pools; pick an environment instead")
+			return
+		}
+		assigned, err := database.CreatePoolReservation(reservation, reservation.EnvPlainName)
+		if err != nil {
+			logger.Debugf("reserve handler received invalid pool reservation: %v", err)
+			setReservationFormCookies(w, formData)
+			redirectInvalidSubmission(w, r, err.Error())
+			return
+		}
+		err = reservesuccessTmpl.Execute(w, newReservationNiceName(assigned))
+		if err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+
+	// get recurrence from form; a reservation which repeats becomes a series
+	rule, repeats, err := recurrenceRuleFromForm(r)
+	if err != nil {
+		logger.Debugf("reserve handler received invalid recurrence rule: %v", err)
+		setReservationFormCookies(w, formData)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+
+	// a reservation together with further environments becomes a bundle
+	if len(r.Form["bundle"]) > 0 {
+		if repeats {
+			setReservationFormCookies(w, formData)
+			redirectInvalidSubmission(w, r, "recurring reservations are not possible for bundles")
+			return
+		}
+		envPlainNames := []string{reservation.EnvPlainName}
+		for _, env := range r.Form["bundle"] {
+			envPlainNames = append(envPlainNames, template.HTMLEscapeString(env))
+		}
+		created, err := database.CreateReservationBundle(reservation, envPlainNames)
+		if err != nil {
+			logger.Debugf("reserve handler received invalid reservation bundle: %v", err)
+			setReservationFormCookies(w, formData)
+			redirectInvalidSubmission(w, r, err.Error())
+			return
+		}
+		createdNice := []reservationNiceName{}
+		for _, c := range created {
+			createdNice = append(createdNice, newReservationNiceName(c))
+		}
+		err = bundlesuccessTmpl.Execute(w, map[string]interface{}{
+			"Username": username,
+			"Created":  createdNice,
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+	if repeats {
+		created, skipped, err := database.CreateReservationSeries(reservation, rule, r.Form.Get("skipconflicts") != "")
+		if err != nil {
+			logger.Debugf("reserve handler received invalid reservation series: %v", err)
+			setReservationFormCookies(w, formData)
+			redirectInvalidSubmission(w, r, err.Error())
+			return
+		}
+		createdNice := []reservationNiceName{}
+		for _, c := range created {
+			createdNice = append(createdNice, newReservationNiceName(c))
+		}
+		err = seriessuccessTmpl.Execute(w, map[string]interface{}{
+			"Username":    username,
+			"EnvNiceName": environmentsMap[reservation.EnvPlainName].NiceName,
+			"Rule":        rule.String(),
+			"Created":     createdNice,
+			"Skipped":     skipped,
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+
+	err = database.CreateReservation(reservation)
+	if err != nil {
+		logger.Debugf("reserve handler received invalid reservation: %v", err)
+		setReservationFormCookies(w, formData)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+
+	err = reservesuccessTmpl.Execute(w, newReservationNiceName(reservation))
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// reservationFromForm reads the fields of the reservation form into a Reservation. It also returns
+// the raw form data, so it can be put into the form again if the reservation is not possible. The
+// returned error is meant to be shown to the user.
+func reservationFromForm(r *http.Request, username string) (util.Reservation, reservationFormData, error) {
 	var reservation util.Reservation
+	var err error
 
 	reservation.User = username
 
 	// get environment from form
 	reservation.EnvPlainName = template.HTMLEscapeString(r.Form.Get("env"))
 	if reservation.EnvPlainName == "" {
-		logger.Debugf("reserve handler received reservation with invalid environment: %v", err)
-		redirectInvalidSubmission(w, r, "environment invalid")
-		return
+		return reservation, reservationFormData{}, fmt.Errorf("environment invalid")
 	}
 
 	// get start from form
@@ -222,9 +449,7 @@ func reserveHandler(w http.ResponseWriter, r *http.Request) {
 	starttimeStr := template.HTMLEscapeString(r.Form.Get("starttime"))
 	reservation.Start, err = time.ParseInLocation(util.TimeLayout, startdateStr+" "+starttimeStr, time.Local)
 	if err != nil {
-		logger.Debugf("reserve handler received reservation with malformed date/time submission: %v", err)
-		redirectInvalidSubmission(w, r, "start date/time malformed")
-		return
+		return reservation, reservationFormData{}, fmt.Errorf("start date/time malformed")
 	}
 
 	// get end from form
@@ -232,9 +457,7 @@ func reserveHandler(w http.ResponseWriter, r *http.Request) {
 	endtimeStr := template.HTMLEscapeString(r.Form.Get("endtime"))
 	reservation.End, err = time.ParseInLocation(util.TimeLayout, enddateStr+" "+endtimeStr, time.Local)
 	if err != nil {
-		logger.Debugf("reserve handler received reservation with malformed date/time submission: %v", err)
-		redirectInvalidSubmission(w, r, "end date/time malformed")
-		return
+		return reservation, reservationFormData{}, fmt.Errorf("end date/time malformed")
 	}
 
 	// get subject from form
@@ -251,18 +474,39 @@ func reserveHandler(w http.ResponseWriter, r *http.Request) {
 		reservation.SendEndMail = true
 	}
 
-	err = database.CreateReservation(reservation)
-	if err != nil {
-		logger.Debugf("reserve handler received invalid reservation: %v", err)
-		setReservationFormCookies(w, reservationFormData{startdateStr, starttimeStr, enddateStr, endtimeStr, reservation.Subject})
-		redirectInvalidSubmission(w, r, err.Error())
-		return
-	}
+	formData := reservationFormData{startdateStr, starttimeStr, enddateStr, endtimeStr, reservation.Subject}
+	return reservation, formData, nil
+}
 
-	err = reservesuccessTmpl.Execute(w, newReservationNiceName(reservation))
-	if err != nil {
-		logger.Error(err)
-	}
+// recurrenceRuleFromForm reads the recurrence part of the reservation form. The second return
+// value is false if the reservation does not repeat. For daily and weekly series, the rule is
+// assembled from the single form fields; a custom rule is given as text.
+func recurrenceRuleFromForm(r *http.Request) (util.RecurrenceRule, bool, error) {
+	var ruleStr string
+	switch r.Form.Get("repeat") {
+	case "", "none":
+		return util.RecurrenceRule{}, false, nil
+	case "custom":
+		ruleStr = r.Form.Get("rule")
+	case "daily", "weekly":
+		parts := []string{"FREQ=" + strings.ToUpper(r.Form.Get("repeat"))}
+		if interval := r.Form.Get("interval"); interval != "" {
+			parts = append(parts, "INTERVAL="+interval)
+		}
+		if r.Form.Get("repeat") == "weekly" && len(r.Form["byday"]) > 0 {
+			parts = append(parts, "BYDAY="+strings.Join(r.Form["byday"], ","))
+		}
+		if count := r.Form.Get("count"); count != "" {
+			parts = append(parts, "COUNT="+count)
+		} else if until := r.Form.Get("until"); until != "" {
+			parts = append(parts, "UNTIL="+until)
+		}
+		ruleStr = strings.Join(parts, ";")
+	default:
+		return util.RecurrenceRule{}, false, fmt.Errorf("repetition invalid")
+	}
+	rule, err := util.ParseRecurrenceRule(template.HTMLEscapeString(ruleStr))
+	return rule, true, err
 }
 
 func addkeyPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,8 +22,12 @@ import (
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/AdvUni/gafaspot/database"
+	"github.com/AdvUni/gafaspot/hooks"
+	"github.com/AdvUni/gafaspot/util"
 	"github.com/AdvUni/gafaspot/vault"
 )
 
@@ -50,13 +54,16 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.Form.Get("name")
 	pass := r.Form.Get("pass")
 
-	if !vault.DoLdapAuthentication(username, pass) {
+	groups, ok := vault.DoLdapAuthentication(username, pass)
+	if !ok {
 		redirectShowLoginError(w, r, "Invalid credentials")
 		return
 	}
 
 	// each time a user logs in, update the TTL for his database entry
 	database.RefreshDeletionDate(username)
+	// the user's groups determine the booking quota
+	database.SaveUserGroups(username, groups)
 
 	renewJWT(w, username)
 	http.Redirect(w, r, mainview, http.StatusSeeOther)
@@ -94,11 +101,253 @@ func abortreservationHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Warningf("abortreservation request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
 		return
 	}
-	database.AbortReservation(username, reservationID)
+	if r.Form.Get("series") != "" {
+		err = database.AbortReservationSeries(username, reservationID)
+		if err != nil {
+			logger.Debugf("abort reservation handler could not abort series: %v", err)
+			redirectInvalidSubmission(w, r, err.Error())
+			return
+		}
+	} else {
+		database.AbortReservation(username, reservationID)
+	}
 	// return to personal view
 	http.Redirect(w, r, personalview, http.StatusSeeOther)
 }
 
+func extendreservationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameters from extend reservation request: %v\n", err)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("extendreservation request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	// get new end from form
+	enddateStr := template.HTMLEscapeString(r.Form.Get("enddate"))
+	endtimeStr := template.HTMLEscapeString(r.Form.Get("endtime"))
+	newEnd, err := time.ParseInLocation(util.TimeLayout, enddateStr+" "+endtimeStr, time.Local)
+	if err != nil {
+		logger.Debugf("extend reservation handler received malformed date/time submission: %v", err)
+		redirectInvalidSubmission(w, r, "end date/time malformed")
+		return
+	}
+
+	err = database.ExtendReservation(username, reservationID, newEnd, vault.ExtendBooking)
+	if err != nil {
+		logger.Debugf("extend reservation handler could not extend reservation: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "Reservation extended until "+newEnd.Format(util.TimeLayout))
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
+func releasereservationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameter id from release reservation request: %v\n", err)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("releasereservation request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	err = database.ReleaseReservation(username, reservationID, vault.EndBooking, hooks.Run)
+	if err != nil {
+		logger.Debugf("release reservation handler could not release reservation: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "Reservation released")
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
+func editreservationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameters from edit reservation request: %v\n", err)
+		return
+	}
+
+	var reservation util.Reservation
+	reservation.User = username
+
+	reservation.ID, err = strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("editreservation request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	// get start from form
+	startdateStr := template.HTMLEscapeString(r.Form.Get("startdate"))
+	starttimeStr := template.HTMLEscapeString(r.Form.Get("starttime"))
+	reservation.Start, err = time.ParseInLocation(util.TimeLayout, startdateStr+" "+starttimeStr, time.Local)
+	if err != nil {
+		logger.Debugf("edit reservation handler received malformed date/time submission: %v", err)
+		redirectInvalidSubmission(w, r, "start date/time malformed")
+		return
+	}
+
+	// get end from form
+	enddateStr := template.HTMLEscapeString(r.Form.Get("enddate"))
+	endtimeStr := template.HTMLEscapeString(r.Form.Get("endtime"))
+	reservation.End, err = time.ParseInLocation(util.TimeLayout, enddateStr+" "+endtimeStr, time.Local)
+	if err != nil {
+		logger.Debugf("edit reservation handler received malformed date/time submission: %v", err)
+		redirectInvalidSubmission(w, r, "end date/time malformed")
+		return
+	}
+
+	// get subject from form
+	reservation.Subject = template.HTMLEscapeString(r.Form.Get("sub"))
+	if reservation.Subject == "" {
+		reservation.Subject = "no subject"
+	}
+
+	// get email checkboxes from form
+	if r.Form.Get("startmail") != "" {
+		reservation.SendStartMail = true
+	}
+	if r.Form.Get("endmail") != "" {
+		reservation.SendEndMail = true
+	}
+
+	if r.Form.Get("series") != "" {
+		err = database.UpdateReservationSeries(reservation)
+	} else {
+		err = database.UpdateReservation(reservation)
+	}
+	if err != nil {
+		logger.Debugf("edit reservation handler could not update reservation: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "Reservation changed")
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
+func sharereservationHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameters from share reservation request: %v\n", err)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("sharereservation request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	// get co-users from form; they are separated by commas
+	coUsers := strings.Split(template.HTMLEscapeString(r.Form.Get("cousers")), ",")
+
+	err = database.SetCoUsers(username, reservationID, coUsers)
+	if err != nil {
+		logger.Debugf("share reservation handler could not share reservation: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "Co-users of reservation changed")
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
+func joinwaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+
+	reservation, formData, err := reservationFromForm(r, username)
+	if err != nil {
+		logger.Debugf("join waitlist handler received invalid submission: %v", err)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+
+	if _, ok := poolsMap[reservation.EnvPlainName]; ok {
+		setReservationFormCookies(w, formData)
+		redirectInvalidSubmission(w, r, "the waitlist is not available for pools; pick an environment instead")
+		return
+	}
+	if len(r.Form["bundle"]) > 0 {
+		setReservationFormCookies(w, formData)
+		redirectInvalidSubmission(w, r, "the waitlist is not available for bundles; join it for each environment instead")
+		return
+	}
+
+	err = database.JoinWaitlist(reservation)
+	if err != nil {
+		logger.Debugf("join waitlist handler could not add entry to waitlist: %v", err)
+		setReservationFormCookies(w, formData)
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	setInfoCookie(w, "You are on the waitlist now. Gafaspot informs you when the time range becomes free")
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
+func leavewaitlistHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warningf("could not get parameter id from leave waitlist request: %v\n", err)
+		return
+	}
+
+	entryID, err := strconv.Atoi(template.HTMLEscapeString(r.Form.Get("id")))
+	if err != nil {
+		logger.Warningf("leavewaitlist request passes an id which is not comparable to int: %v\n", template.HTMLEscapeString(r.Form.Get("id")))
+		return
+	}
+
+	err = database.LeaveWaitlist(username, entryID)
+	if err != nil {
+		redirectInvalidSubmission(w, r, err.Error())
+		return
+	}
+	http.Redirect(w, r, personalview, http.StatusSeeOther)
+}
+
 func deletekeyHandler(w http.ResponseWriter, r *http.Request) {
 	username, ok := verifyUser(w, r)
 	if !ok {
@@ -0,0 +1,117 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdvUni/gafaspot/database"
+	"github.com/AdvUni/gafaspot/util"
+)
+
+var (
+	// lastScanReport is the report of the most recent reservation scan which handled any
+	// reservations. It is written by the scanning routine and read by the web server, so
+	// access it only through scanReportMutex.
+	lastScanReport  util.ScanReport
+	scanReportMutex sync.RWMutex
+
+	// lastReconciliationReport is the report of the most recent reconciliation between database
+	// and Vault. Access it only through scanReportMutex.
+	lastReconciliationReport util.ReconciliationReport
+
+	// instanceName is the name of this Gafaspot instance among all instances sharing the database.
+	instanceName string
+)
+
+// SetInstanceName tells the web interface the name of this Gafaspot instance. Call it before
+// starting the web server.
+func SetInstanceName(name string) {
+	instanceName = name
+}
+
+// SetScanReport hands over the report of a reservation scan to the web interface. Reports of
+// scans which did not handle any reservation are ignored, so the page keeps showing the last
+// scan which actually did something.
+func SetScanReport(report util.ScanReport) {
+	if len(report.Outcomes) == 0 {
+		return
+	}
+	scanReportMutex.Lock()
+	defer scanReportMutex.Unlock()
+	lastScanReport = report
+}
+
+// SetReconciliationReport hands over the report of a reconciliation between database and Vault to
+// the web interface.
+func SetReconciliationReport(report util.ReconciliationReport) {
+	scanReportMutex.Lock()
+	defer scanReportMutex.Unlock()
+	lastReconciliationReport = report
+}
+
+func scanreportPageHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+
+	scanReportMutex.RLock()
+	report := lastScanReport
+	reconciliation := lastReconciliationReport
+	scanReportMutex.RUnlock()
+
+	leader, _ := database.CurrentLeader(time.Now())
+	errormessage := readErrorCookie(w, r)
+
+	err := scanreportTmpl.Execute(w, map[string]interface{}{
+		"Username": username,
+		"Error":    errormessage,
+		"IsAdmin":  isAdmin(username),
+		"Report":   report,
+		"Problems": report.Problems(),
+		"Instance": instanceName,
+		"Leader":   leader,
+
+		"Reconciliation": reconciliation,
+		"Unresolved":     reconciliation.Unresolved(),
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := verifyUser(w, r)
+	if !ok {
+		redirectNotAuthenticated(w, r)
+		return
+	}
+	// a reconciliation may end bookings in Vault, which changes credentials
+	if !isAdmin(username) {
+		logger.Warningf("user %v tried to request a reconciliation without being admin", username)
+		redirectInvalidSubmission(w, r, "only admins can request a reconciliation")
+		return
+	}
+	database.RequestReconciliation(username)
+	http.Redirect(w, r, scanreport, http.StatusSeeOther)
+}
@@ -19,6 +19,7 @@
 package ui
 
 import (
+	"context"
 	"crypto/rand"
 	"html/template"
 	"log"
@@ -35,31 +36,51 @@ import (
 )
 
 const (
-	loginpage        = "/"
-	login            = "/login"
-	logout           = "/logout"
-	mainview         = "/mainview"
-	personalview     = "/personal"
-	credsview        = "/personal/creds"
-	reservationform  = "/newreservation/{env}"
-	reserve          = "/reserve"
-	abortreservation = "/abortreservation"
-	addkeyform       = "/personal/addkey"
-	uploadkey        = "/personal/uploadkey"
-	deletekey        = "/personal/deletekey"
-	addmailform      = "/personal/addmail"
-	uploadmail       = "/personal/uploadmail"
-	deletemail       = "/personal/deletemail"
+	loginpage          = "/"
+	login              = "/login"
+	logout             = "/logout"
+	mainview           = "/mainview"
+	personalview       = "/personal"
+	credsview          = "/personal/creds"
+	reservationform    = "/newreservation/{env}"
+	reserve            = "/reserve"
+	abortreservation   = "/abortreservation"
+	extendreservation  = "/extendreservation"
+	releasereservation = "/releasereservation"
+	editreservation    = "/editreservation"
+	sharereservation   = "/sharereservation"
+	joinwaitlist       = "/joinwaitlist"
+	leavewaitlist      = "/leavewaitlist"
+	addkeyform         = "/personal/addkey"
+	uploadkey          = "/personal/uploadkey"
+	deletekey          = "/personal/deletekey"
+	addmailform        = "/personal/addmail"
+	uploadmail         = "/personal/uploadmail"
+	deletemail         = "/personal/deletemail"
+	scanreport         = "/scanreport"
+	reconcile          = "/reconcile"
+	maintenance        = "/maintenance"
+	addmaintenance     = "/addmaintenance"
+	deletemaintenance  = "/deletemaintenance"
+	approvals          = "/approvals"
+	approvereservation = "/approvereservation"
+	rejectreservation  = "/rejectreservation"
 )
 
 var (
 	logger logging.Logger
 
+	// server is the http server started by RunWebserver. ShutdownWebserver stops it.
+	server = &http.Server{}
+
 	// This list contains all environment information from database table "environments".
 	// This table shouldn't change during runtime, so the list content can be fetched once at program start.
 	environments []util.Environment
 	// This maps associates each environment with its PlainName attribute for a fast lookup.
 	environmentsMap map[string]util.Environment
+	// The same for pools of environments, which are fetched from database tables "pools" and "pool_members".
+	pools    []util.Pool
+	poolsMap map[string]util.Pool
 
 	// The following are the parsed templates for all the application's web pages, ready for execution with the right parameters.
 	loginformTmpl       *template.Template
@@ -67,11 +88,16 @@ var (
 	personalviewTmpl    *template.Template
 	reservationformTmpl *template.Template
 	reservesuccessTmpl  *template.Template
+	seriessuccessTmpl   *template.Template
+	bundlesuccessTmpl   *template.Template
 	credsviewTmpl       *template.Template
 	addkeyformTmpl      *template.Template
 	addkeysuccessTmpl   *template.Template
 	addmailformTmpl     *template.Template
 	addmailsuccessTmpl  *template.Template
+	scanreportTmpl      *template.Template
+	maintenanceTmpl     *template.Template
+	approvalsTmpl       *template.Template
 )
 
 // all initialization which does not need parameters from main routine.
@@ -94,11 +120,16 @@ func init() {
 		personalviewTmplFile    = "ui/templates/personalview.html"
 		reservationformTmplFile = "ui/templates/newreservation.html"
 		reservesuccessTmplFile  = "ui/templates/reservesuccess.html"
+		seriessuccessTmplFile   = "ui/templates/seriessuccess.html"
+		bundlesuccessTmplFile   = "ui/templates/bundlesuccess.html"
 		credsviewTmplFile       = "ui/templates/credsview.html"
 		addkeyformTmplFile      = "ui/templates/addkey.html"
 		addkeysuccessTmplFile   = "ui/templates/addkeysuccess.html"
 		addmailformTmplFile     = "ui/templates/addmail.html"
 		addmailsuccessTmplFile  = "ui/templates/addmailsuccess.html"
+		scanreportTmplFile      = "ui/templates/scanreport.html"
+		maintenanceTmplFile     = "ui/templates/maintenance.html"
+		approvalsTmplFile       = "ui/templates/approvals.html"
 	)
 	loginformTmpl, err = template.ParseFiles(loginformTmplFile, topTmplFile, bottomTmplFile)
 	if err != nil {
@@ -107,6 +138,7 @@ func init() {
 	mainviewTmpl, err = template.New(path.Base(mainviewTmplFile)).Funcs(template.FuncMap{
 		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
 		"past":           func(r util.Reservation) bool { return r.End.Before(time.Now()) },
+		"cleanupEnd":     func(r util.Reservation, buffer time.Duration) time.Time { return r.End.Add(buffer) },
 	}).ParseFiles(mainviewTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
 	if err != nil {
 		log.Fatal(err)
@@ -123,11 +155,26 @@ func init() {
 		log.Fatal(err)
 	}
 	reservesuccessTmpl, err = template.New(path.Base(reservesuccessTmplFile)).Funcs(template.FuncMap{
-		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+		"formatDatetime":   func(t time.Time) string { return t.Format(util.TimeLayout) },
+		"requiresApproval": func(envPlainName string) bool { return environmentsMap[envPlainName].RequiresApproval },
 	}).ParseFiles(reservesuccessTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	seriessuccessTmpl, err = template.New(path.Base(seriessuccessTmplFile)).Funcs(template.FuncMap{
+		"formatDatetime":   func(t time.Time) string { return t.Format(util.TimeLayout) },
+		"requiresApproval": func(envPlainName string) bool { return environmentsMap[envPlainName].RequiresApproval },
+	}).ParseFiles(seriessuccessTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bundlesuccessTmpl, err = template.New(path.Base(bundlesuccessTmplFile)).Funcs(template.FuncMap{
+		"formatDatetime":   func(t time.Time) string { return t.Format(util.TimeLayout) },
+		"requiresApproval": func(envPlainName string) bool { return environmentsMap[envPlainName].RequiresApproval },
+	}).ParseFiles(bundlesuccessTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 	credsviewTmpl, err = template.New(path.Base(credsviewTmplFile)).Funcs(template.FuncMap{
 		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
 	}).ParseFiles(credsviewTmplFile, topTmplFile, bottomTmplFile, navTmplFile, wordbreakTmplFile)
@@ -150,9 +197,28 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	scanreportTmpl, err = template.New(path.Base(scanreportTmplFile)).Funcs(template.FuncMap{
+		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+	}).ParseFiles(scanreportTmplFile, topTmplFile, bottomTmplFile, navTmplFile, wordbreakTmplFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maintenanceTmpl, err = template.New(path.Base(maintenanceTmplFile)).Funcs(template.FuncMap{
+		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+	}).ParseFiles(maintenanceTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	approvalsTmpl, err = template.New(path.Base(approvalsTmplFile)).Funcs(template.FuncMap{
+		"formatDatetime": func(t time.Time) string { return t.Format(util.TimeLayout) },
+	}).ParseFiles(approvalsTmplFile, topTmplFile, bottomTmplFile, navTmplFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// RunWebserver registers all page handlers to a router and then starts the web server.
+// RunWebserver registers all page handlers to a router and then starts the web server. It returns
+// after the web server was stopped by ShutdownWebserver.
 func RunWebserver(l logging.Logger, addr string) {
 	logger = l
 
@@ -164,6 +230,13 @@ func RunWebserver(l logging.Logger, addr string) {
 	sort.Slice(environments, func(i, j int) bool {
 		return environments[i].NiceName < environments[j].NiceName
 	})
+	poolsMap = database.GetPools()
+	for _, p := range poolsMap {
+		pools = append(pools, p)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].NiceName < pools[j].NiceName
+	})
 
 	// create router and register all paths
 	router := mux.NewRouter()
@@ -177,17 +250,42 @@ func RunWebserver(l logging.Logger, addr string) {
 	router.HandleFunc(reservationform, newreservationPageHandler)
 	router.HandleFunc(reserve, reserveHandler)
 	router.HandleFunc(abortreservation, abortreservationHandler)
+	router.HandleFunc(extendreservation, extendreservationHandler).Methods(http.MethodPost)
+	router.HandleFunc(releasereservation, releasereservationHandler).Methods(http.MethodPost)
+	router.HandleFunc(editreservation, editreservationHandler).Methods(http.MethodPost)
+	router.HandleFunc(sharereservation, sharereservationHandler).Methods(http.MethodPost)
+	router.HandleFunc(joinwaitlist, joinwaitlistHandler).Methods(http.MethodPost)
+	router.HandleFunc(leavewaitlist, leavewaitlistHandler).Methods(http.MethodPost)
 	router.HandleFunc(addkeyform, addkeyPageHandler)
 	router.HandleFunc(uploadkey, uploadkeyHandler)
 	router.HandleFunc(deletekey, deletekeyHandler)
 	router.HandleFunc(addmailform, addmailPageHandler)
 	router.HandleFunc(uploadmail, uploadmailHandler)
 	router.HandleFunc(deletemail, deletemailHandler)
+	router.HandleFunc(scanreport, scanreportPageHandler)
+	router.HandleFunc(reconcile, reconcileHandler).Methods(http.MethodPost)
+	router.HandleFunc(maintenance, maintenancePageHandler)
+	router.HandleFunc(addmaintenance, addmaintenanceHandler).Methods(http.MethodPost)
+	router.HandleFunc(deletemaintenance, deletemaintenanceHandler).Methods(http.MethodPost)
+	router.HandleFunc(approvals, approvalsPageHandler)
+	router.HandleFunc(approvereservation, approvereservationHandler).Methods(http.MethodPost)
+	router.HandleFunc(rejectreservation, rejectreservationHandler).Methods(http.MethodPost)
 
 	// start web server
 	http.Handle(loginpage, router)
-	err := http.ListenAndServe(addr, nil)
+	server.Addr = addr
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		logger.Info("web server stopped")
+		return
+	}
 	// cause entire program to stop if the server crashes for any reason
 	logger.Emergencyf("webserver crashed: %v\n", err)
 	os.Exit(1)
 }
+
+// ShutdownWebserver stops the web server gracefully. It stops accepting new requests and waits
+// until all running requests are finished or ctx is done.
+func ShutdownWebserver(ctx context.Context) error {
+	return server.Shutdown(ctx)
+}
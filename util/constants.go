@@ -37,4 +37,67 @@ const (
 	SecEngTypeSSHPubkey = "ssh-pubkey"
 	// SecEngTypeSSH is the type for SSH Secrets Engine.
 	SecEngTypeSSH = "ssh"
+
+	// Statuses are constant strings to define the states of a reservation's lifecycle. Which
+	// transitions between them are allowed is defined in the database package.
+
+	// StatusPending is the status of a reservation which waits for the approval of an approver,
+	// as its environment requires approval.
+	StatusPending = "pending"
+	// StatusUpcoming is the status of a reservation whose start time is not reached yet.
+	StatusUpcoming = "upcoming"
+	// StatusStarting is the status of a reservation while Gafaspot starts it in Vault.
+	StatusStarting = "starting"
+	// StatusActive is the status of a reservation which was started successfully.
+	StatusActive = "active"
+	// StatusPartial is the status of a reservation which was started only for some Secrets Engines.
+	StatusPartial = "partial"
+	// StatusEnding is the status of a reservation while Gafaspot ends it in Vault.
+	StatusEnding = "ending"
+	// StatusExpired is the status of a reservation which was ended successfully.
+	StatusExpired = "expired"
+	// StatusAborted is the status of a reservation which was aborted by its user before it started.
+	StatusAborted = "aborted"
+	// StatusRejected is the status of a reservation which was not approved by an approver.
+	StatusRejected = "rejected"
+	// StatusFailed is the status of a reservation which could not be started.
+	StatusFailed = "failed"
+	// StatusError is the status of a reservation which could not be processed properly.
+	StatusError = "error"
+
+	// Actions are constant strings to name the transitions Gafaspot performs on reservations.
+
+	// ActionStart is the action of starting a reservation.
+	ActionStart = "start"
+	// ActionEnd is the action of ending a reservation.
+	ActionEnd = "end"
+
+	// Hook stages are constant strings to name the points in a reservation's lifecycle at which
+	// Gafaspot runs the hooks configured for its environment.
+
+	// HookBeforeStart is the stage right before a reservation gets started in Vault.
+	HookBeforeStart = "before-start"
+	// HookAfterEnd is the stage right after a reservation was ended in Vault.
+	HookAfterEnd = "after-end"
+
+	// Findings are constant strings to name the inconsistencies a reconciliation between database
+	// and Vault can reveal.
+
+	// FindingOrphanedCreds means there are credentials stored in Vault for an environment, though
+	// there is no reservation holding it.
+	FindingOrphanedCreds = "orphaned credentials"
+	// FindingMissingCreds means there is an active reservation for an environment, though Vault
+	// does not store credentials for all of its Secrets Engines.
+	FindingMissingCreds = "missing credentials"
+	// FindingInspectionFailed means Gafaspot could not find out which credentials Vault stores for
+	// an environment.
+	FindingInspectionFailed = "inspection failed"
+
+	// WaitlistPolicies define what Gafaspot does for the users on an environment's waitlist when a
+	// time range becomes free.
+
+	// WaitlistPolicyNotify lets Gafaspot inform the first waiting user, who can book the time range then.
+	WaitlistPolicyNotify = "notify"
+	// WaitlistPolicyBook lets Gafaspot create the reservation for the first waiting user right away.
+	WaitlistPolicyBook = "book"
 )
@@ -21,6 +21,7 @@ package util
 import (
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // CreatePlainIdentifier replaces all characters which are not ascii letters oder numbers through an underscore
@@ -28,3 +29,25 @@ func CreatePlainIdentifier(name string) string {
 	re := regexp.MustCompile(`[^a-zA-Z0-9]`)
 	return strings.ToLower(re.ReplaceAllString(name, "_"))
 }
+
+// RunParallel calls f for every index from 0 to n-1. The calls run concurrently, but at most limit
+// of them at the same time. If limit is smaller than 1, the calls run one after another.
+// RunParallel returns after all calls are done. To gather results deterministically, let f store
+// them at index i of a slice with length n.
+func RunParallel(n, limit int, f func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,220 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FrequencyDaily lets a reservation series repeat every Interval days.
+	FrequencyDaily = "DAILY"
+	// FrequencyWeekly lets a reservation series repeat on the given weekdays every Interval weeks.
+	FrequencyWeekly = "WEEKLY"
+
+	// DateLayout is the layout of the UNTIL part of recurrence rules.
+	DateLayout = "2006-01-02"
+)
+
+var weekdayAbbreviations = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// RecurrenceRule describes how a reservation series repeats. It follows the RRULE format of
+// iCalendar, but only supports its most common parts, e.g. "FREQ=WEEKLY;BYDAY=TU,TH;UNTIL=2020-06-30"
+// or "FREQ=DAILY;INTERVAL=2;COUNT=10". Either Until or Count must be set, so a series always
+// ends.
+type RecurrenceRule struct {
+	Frequency string
+	// Interval is the number of days or weeks between two repetitions. Defaults to 1.
+	Interval int
+	// Weekdays are the days on which a weekly series repeats. If empty, the series repeats on the
+	// weekday of its first occurrence.
+	Weekdays []time.Weekday
+	// Until is the date of the last possible occurrence. Zero if Count is used instead.
+	Until time.Time
+	// Count is the number of occurrences. Zero if Until is used instead.
+	Count int
+}
+
+// ParseRecurrenceRule reads a rule like "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=8". The parts are
+// separated by semicolons and may appear in any order. UNTIL is a date in the format 2006-01-02;
+// the iCalendar format 20060102 is accepted as well.
+func ParseRecurrenceRule(rule string) (RecurrenceRule, error) {
+	r := RecurrenceRule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:"), ";") {
+		if part == "" {
+			continue
+		}
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return RecurrenceRule{}, fmt.Errorf("malformed part '%v' in recurrence rule", part)
+		}
+		key, value := strings.ToUpper(strings.TrimSpace(keyValue[0])), strings.ToUpper(strings.TrimSpace(keyValue[1]))
+
+		var err error
+		switch key {
+		case "FREQ":
+			if value != FrequencyDaily && value != FrequencyWeekly {
+				return RecurrenceRule{}, fmt.Errorf("unsupported frequency '%v'; use %v or %v", value, FrequencyDaily, FrequencyWeekly)
+			}
+			r.Frequency = value
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err != nil || r.Interval < 1 {
+				return RecurrenceRule{}, fmt.Errorf("interval must be a positive number, got '%v'", value)
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err != nil || r.Count < 1 {
+				return RecurrenceRule{}, fmt.Errorf("count must be a positive number, got '%v'", value)
+			}
+		case "UNTIL":
+			r.Until, err = time.ParseInLocation(DateLayout, value, time.Local)
+			if err != nil {
+				r.Until, err = time.ParseInLocation("20060102", value, time.Local)
+			}
+			if err != nil {
+				return RecurrenceRule{}, fmt.Errorf("until must be a date like 2006-01-02, got '%v'", value)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := weekdayAbbreviations[strings.TrimSpace(day)]
+				if !ok {
+					return RecurrenceRule{}, fmt.Errorf("unknown weekday '%v'; use MO, TU, WE, TH, FR, SA or SU", day)
+				}
+				if !containsWeekday(r.Weekdays, weekday) {
+					r.Weekdays = append(r.Weekdays, weekday)
+				}
+			}
+		default:
+			return RecurrenceRule{}, fmt.Errorf("unsupported part '%v' in recurrence rule", key)
+		}
+	}
+
+	if r.Frequency == "" {
+		return RecurrenceRule{}, fmt.Errorf("recurrence rule needs a frequency (FREQ)")
+	}
+	if r.Count == 0 && r.Until.IsZero() {
+		return RecurrenceRule{}, fmt.Errorf("recurrence rule needs either an end date (UNTIL) or a number of occurrences (COUNT)")
+	}
+	if r.Count != 0 && !r.Until.IsZero() {
+		return RecurrenceRule{}, fmt.Errorf("recurrence rule must not contain both UNTIL and COUNT")
+	}
+	if len(r.Weekdays) > 0 && r.Frequency != FrequencyWeekly {
+		return RecurrenceRule{}, fmt.Errorf("weekdays (BYDAY) are only supported for weekly series")
+	}
+	return r, nil
+}
+
+// String returns the rule in the format understood by ParseRecurrenceRule.
+func (r RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Frequency}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%v", r.Interval))
+	}
+	if len(r.Weekdays) > 0 {
+		days := make([]string, len(r.Weekdays))
+		for i, weekday := range r.Weekdays {
+			days[i] = strings.ToUpper(weekday.String()[:2])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%v", r.Count))
+	} else {
+		parts = append(parts, "UNTIL="+r.Until.Format(DateLayout))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences returns the start times of all occurrences of a series whose first occurrence
+// starts at first. The time of day is the same for all of them. The first occurrence is always
+// part of the series, even if it does not fall on one of the rule's weekdays. The function stops
+// after limit+1 occurrences, so callers can recognise series which are too long.
+func (r RecurrenceRule) Occurrences(first time.Time, limit int) []time.Time {
+	occurrences := []time.Time{first}
+	done := func(t time.Time) bool {
+		if len(occurrences) > limit {
+			return true
+		}
+		if r.Count > 0 {
+			return len(occurrences) >= r.Count
+		}
+		// the series ends with the day given as Until
+		return !t.Before(r.Until.AddDate(0, 0, 1))
+	}
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	if r.Frequency == FrequencyDaily {
+		for k := interval; ; k += interval {
+			next := first.AddDate(0, 0, k)
+			if done(next) {
+				return occurrences
+			}
+			occurrences = append(occurrences, next)
+		}
+	}
+
+	// weekly: walk through the weeks, which begin on monday like in iCalendar
+	weekdays := r.Weekdays
+	if len(weekdays) == 0 {
+		weekdays = []time.Weekday{first.Weekday()}
+	}
+	offsets := make([]int, len(weekdays))
+	for i, weekday := range weekdays {
+		offsets[i] = (int(weekday) + 6) % 7
+	}
+	sort.Ints(offsets)
+	weekStart := first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+	for week := 0; ; week += interval {
+		for _, offset := range offsets {
+			next := weekStart.AddDate(0, 0, 7*week+offset)
+			if !next.After(first) {
+				continue
+			}
+			if done(next) {
+				return occurrences
+			}
+			occurrences = append(occurrences, next)
+		}
+	}
+}
+
+func containsWeekday(weekdays []time.Weekday, weekday time.Weekday) bool {
+	for _, w := range weekdays {
+		if w == weekday {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+// Copyright 2019, Advanced UniByte GmbH.
+// Author Marie Lohbeck.
+//
+// This file is part of Gafaspot.
+//
+// Gafaspot is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Gafaspot is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Gafaspot.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrenceRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    RecurrenceRule
+		wantErr bool
+	}{
+		{rule: "FREQ=DAILY;COUNT=10", want: RecurrenceRule{Frequency: FrequencyDaily, Interval: 1, Count: 10}},
+		{rule: "RRULE:freq=weekly;byday=tu,th;interval=2;until=2020-06-30", want: RecurrenceRule{Frequency: FrequencyWeekly, Interval: 2, Weekdays: []time.Weekday{time.Tuesday, time.Thursday}, Until: time.Date(2020, 6, 30, 0, 0, 0, 0, time.Local)}},
+		{rule: "FREQ=WEEKLY;UNTIL=20200630;BYDAY=MO,MO", want: RecurrenceRule{Frequency: FrequencyWeekly, Interval: 1, Weekdays: []time.Weekday{time.Monday}, Until: time.Date(2020, 6, 30, 0, 0, 0, 0, time.Local)}},
+		{rule: "COUNT=10", wantErr: true},
+		{rule: "FREQ=MONTHLY;COUNT=10", wantErr: true},
+		{rule: "FREQ=DAILY", wantErr: true},
+		{rule: "FREQ=DAILY;COUNT=10;UNTIL=2020-06-30", wantErr: true},
+		{rule: "FREQ=DAILY;COUNT=0", wantErr: true},
+		{rule: "FREQ=DAILY;INTERVAL=0;COUNT=10", wantErr: true},
+		{rule: "FREQ=DAILY;UNTIL=30.06.2020", wantErr: true},
+		{rule: "FREQ=DAILY;BYDAY=MO;COUNT=10", wantErr: true},
+		{rule: "FREQ=WEEKLY;BYDAY=XY;COUNT=10", wantErr: true},
+		{rule: "FREQ=WEEKLY;BYMONTH=6;COUNT=10", wantErr: true},
+		{rule: "FREQ=WEEKLY;COUNT", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseRecurrenceRule(test.rule)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseRecurrenceRule(%q) = %+v, want an error", test.rule, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecurrenceRule(%q) returned error: %v", test.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseRecurrenceRule(%q) = %+v, want %+v", test.rule, got, test.want)
+		}
+		again, err := ParseRecurrenceRule(got.String())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("rule %q does not survive String(): got %+v, %v", got.String(), again, err)
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	// 2020-06-01 is a monday
+	monday := time.Date(2020, 6, 1, 9, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		rule  string
+		first time.Time
+		want  []string
+	}{
+		{
+			name:  "daily with count",
+			rule:  "FREQ=DAILY;COUNT=3",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-02", "2020-06-03"},
+		},
+		{
+			name:  "daily until includes the last day",
+			rule:  "FREQ=DAILY;UNTIL=2020-06-04",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-02", "2020-06-03", "2020-06-04"},
+		},
+		{
+			name:  "daily with interval and count",
+			rule:  "FREQ=DAILY;INTERVAL=2;COUNT=3",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-03", "2020-06-05"},
+		},
+		{
+			name:  "daily with interval and until",
+			rule:  "FREQ=DAILY;INTERVAL=3;UNTIL=2020-06-09",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-04", "2020-06-07"},
+		},
+		{
+			name:  "until before the second occurrence",
+			rule:  "FREQ=DAILY;UNTIL=2020-05-20",
+			first: monday,
+			want:  []string{"2020-06-01"},
+		},
+		{
+			name:  "weekly on the weekday of the first occurrence",
+			rule:  "FREQ=WEEKLY;COUNT=3",
+			first: monday.AddDate(0, 0, 2),
+			want:  []string{"2020-06-03", "2020-06-10", "2020-06-17"},
+		},
+		{
+			name:  "weekly with first occurrence not on a listed weekday",
+			rule:  "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=4",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-02", "2020-06-04", "2020-06-09"},
+		},
+		{
+			name:  "weekly across the week boundary with until",
+			rule:  "FREQ=WEEKLY;BYDAY=FR,MO;UNTIL=2020-06-15",
+			first: monday.AddDate(0, 0, 4),
+			want:  []string{"2020-06-05", "2020-06-08", "2020-06-12", "2020-06-15"},
+		},
+		{
+			name:  "weekly starting on sunday, the last day of the week",
+			rule:  "FREQ=WEEKLY;BYDAY=SU,MO;COUNT=4",
+			first: monday.AddDate(0, 0, 6),
+			want:  []string{"2020-06-07", "2020-06-08", "2020-06-14", "2020-06-15"},
+		},
+		{
+			name:  "weekly with interval",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=5",
+			first: monday,
+			want:  []string{"2020-06-01", "2020-06-03", "2020-06-15", "2020-06-17", "2020-06-29"},
+		},
+		{
+			name:  "weekly with interval across the week boundary",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=SA,TU;UNTIL=2020-06-30",
+			first: monday.AddDate(0, 0, 5),
+			want:  []string{"2020-06-06", "2020-06-16", "2020-06-20", "2020-06-30"},
+		},
+	}
+	for _, test := range tests {
+		rule, err := ParseRecurrenceRule(test.rule)
+		if err != nil {
+			t.Fatalf("%v: ParseRecurrenceRule(%q) returned error: %v", test.name, test.rule, err)
+		}
+		var got []string
+		for _, occurrence := range rule.Occurrences(test.first, 200) {
+			if occurrence.Hour() != test.first.Hour() || occurrence.Minute() != test.first.Minute() {
+				t.Errorf("%v: occurrence %v does not start at the time of day of the first one", test.name, occurrence)
+			}
+			got = append(got, occurrence.Format(DateLayout))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOccurrencesLimit(t *testing.T) {
+	first := time.Date(2020, 6, 1, 9, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		rule string
+		want int
+	}{
+		// series which are too long are cut after limit+1 occurrences, so callers notice
+		{rule: "FREQ=DAILY;COUNT=500", want: 201},
+		{rule: "FREQ=DAILY;UNTIL=2030-12-31", want: 201},
+		{rule: "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR;UNTIL=2030-12-31", want: 201},
+		// series which reach the limit exactly are complete
+		{rule: "FREQ=DAILY;COUNT=200", want: 200},
+		{rule: "FREQ=WEEKLY;COUNT=199", want: 199},
+	}
+	for _, test := range tests {
+		rule, err := ParseRecurrenceRule(test.rule)
+		if err != nil {
+			t.Fatalf("ParseRecurrenceRule(%q) returned error: %v", test.rule, err)
+		}
+		if got := len(rule.Occurrences(first, 200)); got != test.want {
+			t.Errorf("%v: got %v occurrences, want %v", test.rule, got, test.want)
+		}
+	}
+}
@@ -19,7 +19,9 @@
 package util
 
 import (
+	"fmt"
 	"html/template"
+	"strings"
 	"time"
 )
 
@@ -30,6 +32,11 @@ type GafaspotConfig struct {
 	Mailserver          string                       `mapstructure:"mailserver"`
 	GafaspotMailAddress string                       `mapstructure:"gafaspot-mailaddress"`
 	ScanningInterval    string                       `mapstructure:"scanning-interval"`
+	RetryMaxAttempts    int                          `mapstructure:"retry-max-attempts"`
+	RetryBackoff        string                       `mapstructure:"retry-backoff"`
+	MaxParallel         int                          `mapstructure:"max-parallel-operations"`
+	InstanceName        string                       `mapstructure:"instance-name"`
+	LeaderLease         string                       `mapstructure:"leader-lease-duration"`
 	MaxBookingDays      int                          `mapstructure:"max-reservation-duration-days"`
 	MaxQueuingMonths    int                          `mapstructure:"max-queuing-time-months"`
 	Database            string                       `mapstructure:"db-path"`
@@ -38,7 +45,44 @@ type GafaspotConfig struct {
 	ApproleID           string                       `mapstructure:"approle-roleID"`
 	ApproleSecret       string                       `mapstructure:"approle-secretID"`
 	UserPolicy          string                       `mapstructure:"ldap-group-policy"`
+	AdminPolicy         string                       `mapstructure:"admin-policy"`
 	Environments        map[string]EnvironmentConfig //`yaml:"environments"`
+	Pools               map[string]PoolConfig        `mapstructure:"pools"`
+	Quotas              QuotasConfig                 `mapstructure:"quotas"`
+}
+
+// QuotasConfig is a struct to load the booking quotas from config file. Default applies to all
+// users, unless there is an entry for the user in Users or for one of the user's groups in Groups.
+// Groups are the Vault policies which Vault assigns to a user at LDAP login, usually derived from
+// the user's LDAP groups.
+type QuotasConfig struct {
+	Default QuotaConfig            `mapstructure:"default"`
+	Users   map[string]QuotaConfig `mapstructure:"users"`
+	Groups  map[string]QuotaConfig `mapstructure:"groups"`
+}
+
+// QuotaConfig is a struct to load one set of booking quotas from config file. A value of zero
+// means that there is no limit.
+type QuotaConfig struct {
+	// MaxConcurrent limits the number of reservations a user may hold at the same point in time.
+	// All reservations whose times overlap count, not only the active ones.
+	MaxConcurrent int `mapstructure:"max-concurrent-reservations"`
+	// MaxUpcoming limits the number of upcoming reservations a user may have.
+	MaxUpcoming int `mapstructure:"max-upcoming-reservations"`
+	// MaxHours limits the hours a user may book within any period of WindowDays days.
+	MaxHours   int `mapstructure:"max-booked-hours"`
+	WindowDays int `mapstructure:"booked-hours-window-days"`
+}
+
+// PoolConfig is a struct to load information about one pool from config file. A pool is a group
+// of equivalent environments; users can book any one of them without picking it.
+type PoolConfig struct {
+	NiceName     string   `mapstructure:"show-name"`
+	Description  string   //`yaml:"description"`
+	Environments []string `mapstructure:"environments"`
+	// Reassign allows Gafaspot to move an upcoming reservation to another member of the pool, if
+	// the assigned environment becomes unavailable before the reservation starts.
+	Reassign bool `mapstructure:"reassign-before-start"`
 }
 
 // EnvironmentConfig is a struct to load information about one environment from config file.
@@ -46,6 +90,40 @@ type EnvironmentConfig struct {
 	NiceName       string                `mapstructure:"show-name"`
 	Description    string                //`yaml:"description"`
 	SecretsEngines []SecretsEngineConfig `mapstructure:"secrets-engines"`
+	WaitlistPolicy string                `mapstructure:"waitlist-policy"`
+	Maintenance    []MaintenanceConfig   `mapstructure:"maintenance"`
+	CleanupBuffer  string                `mapstructure:"cleanup-buffer"`
+	Hooks          HooksConfig           `mapstructure:"hooks"`
+	// RequiresApproval makes reservations for the environment wait for the approval of a user
+	// with the Vault policy ApproverPolicy.
+	RequiresApproval bool   `mapstructure:"requires-approval"`
+	ApproverPolicy   string `mapstructure:"approver-policy"`
+}
+
+// HooksConfig is a struct to load the hooks of an environment from config file. The hooks of a
+// stage run one after another; a failed hook stops the following ones. If BlockOnFailure is set,
+// a failed hook keeps the next reservation of the environment from starting.
+type HooksConfig struct {
+	BeforeStart    []HookConfig `mapstructure:"before-start"`
+	AfterEnd       []HookConfig `mapstructure:"after-end"`
+	BlockOnFailure bool         `mapstructure:"block-next-on-failure"`
+}
+
+// HookConfig is a struct to load one hook from config file. A hook is either a local command,
+// which gets the reservation as JSON on stdin, or an URL, to which the reservation gets posted as
+// JSON. Timeout is a duration string.
+type HookConfig struct {
+	Command []string `mapstructure:"command"`
+	URL     string   `mapstructure:"url"`
+	Timeout string   `mapstructure:"timeout"`
+}
+
+// MaintenanceConfig is a struct to load one maintenance window of an environment from config
+// file. Start and End are in the format of TimeLayout.
+type MaintenanceConfig struct {
+	Start  string `mapstructure:"start"`
+	End    string `mapstructure:"end"`
+	Reason string `mapstructure:"reason"`
 }
 
 // SecretsEngineConfig is a struct to load information about one Secret Engine from config file.
@@ -58,12 +136,29 @@ type SecretsEngineConfig struct {
 // Environment is a struct to store the information of one row from database table environments.
 // The Description is of type template.HTML, as this type will not be escaped when served with a
 // golang http.Template. This enables the gafaspot config writer to put some HTML code inside the
-// descriptions for the environments.
+// descriptions for the environments. CleanupBuffer is the time the environment needs after the end
+// of a reservation, before the next one may start. If RequiresApproval is set, reservations for the
+// environment need the approval of a user with the Vault policy ApproverPolicy.
 type Environment struct {
+	NiceName         string
+	PlainName        string
+	HasSSH           bool
+	Description      template.HTML
+	WaitlistPolicy   string
+	CleanupBuffer    time.Duration
+	RequiresApproval bool
+	ApproverPolicy   string
+}
+
+// Pool is a struct to store the information of one row from database table pools together with
+// the plain names of its member environments.
+type Pool struct {
 	NiceName    string
 	PlainName   string
-	HasSSH      bool
 	Description template.HTML
+	Members     []string
+	HasSSH      bool
+	Reassign    bool
 }
 
 // Reservation is a struct to store the information of one row from database table reservations.
@@ -79,6 +174,82 @@ type Reservation struct {
 	SendEndMail   bool
 	Subject       string
 	Labels        string
+	ErrorDetail   string
+	Attempts      int
+	// SeriesID links the occurrences of a recurring reservation. Zero for single reservations.
+	SeriesID int
+	// Pool is the pool through which the reservation was booked. Empty if the user picked the
+	// environment directly.
+	Pool string
+	// BundleID links reservations for several environments which were booked together and get
+	// started and ended together. Zero for reservations which are not part of a bundle.
+	BundleID int
+	// CoUsers are the users with whom the owner shares the reservation. They see the reservation
+	// and get its credentials. Only filled where it is needed.
+	CoUsers []string
+}
+
+// WaitlistEntry is a struct to store the information of one row from database table waitlist.
+// It describes a time range for which a user waits, because the environment is occupied. The
+// fields for the reservation which gets created from the entry are the same as for Reservation.
+// Notified is the point in time at which Gafaspot informed the user that the time range is free
+// and is zero if this did not happen yet.
+type WaitlistEntry struct {
+	ID            int
+	User          string
+	EnvPlainName  string
+	Start         time.Time
+	End           time.Time
+	Subject       string
+	SendStartMail bool
+	SendEndMail   bool
+	Created       time.Time
+	Notified      time.Time
+}
+
+// HookResult describes one run of a hook for a reservation. Hook is the command or URL of the hook
+// and Output is what it returned, shortened if necessary.
+type HookResult struct {
+	Stage   string
+	Hook    string
+	Time    time.Time
+	Success bool
+	Output  string
+}
+
+// MaintenanceWindow is a struct to store the information of one row from database table
+// maintenance_windows. During a maintenance window, an environment can not be reserved.
+// FromConfig tells whether the window is defined in config file; otherwise, an admin added it at
+// runtime and Creator is his username.
+type MaintenanceWindow struct {
+	ID           int
+	EnvPlainName string
+	Start        time.Time
+	End          time.Time
+	Reason       string
+	Creator      string
+	FromConfig   bool
+}
+
+// SeriesConflict describes an occurrence of a reservation series which could not be created,
+// together with the reason.
+type SeriesConflict struct {
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+// ReservationEvent is a struct to store the information of one row from database table
+// reservation_events. Each event describes one transition of a reservation's status. FromStatus
+// is empty for the event which created the reservation. Actor is either a username or "gafaspot"
+// for transitions which Gafaspot performed on its own.
+type ReservationEvent struct {
+	ReservationID int
+	Time          time.Time
+	FromStatus    string
+	ToStatus      string
+	Actor         string
+	Reason        string
 }
 
 // ReservationCreds is a struct to bundle up credentials for a reservation. ReservationCreds
@@ -91,3 +262,184 @@ type ReservationCreds struct {
 	Env   Environment
 	Creds map[string]map[string]interface{}
 }
+
+// SecEngResult is a struct to store the outcome of starting or ending a booking for one single
+// Secrets Engine. If the operation succeeded, Err is nil.
+// If a successfully started booking had to be undone afterwards, because other Secrets Engines
+// of the same environment failed, RolledBack is true. If undoing it failed, RollbackErr is set
+// and the Secrets Engine still holds the booking.
+// LeaseIDs are the ids of all Vault leases the Secrets Engine created when starting the booking.
+type SecEngResult struct {
+	SecEngName  string
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+	LeaseIDs    []string
+}
+
+// holdsBooking returns true if the Secrets Engine was started successfully and this was not
+// undone afterwards.
+func (s SecEngResult) holdsBooking() bool {
+	return s.Err == nil && !s.RolledBack
+}
+
+// BookingResult is a struct to store the outcome of starting or ending a booking for a whole
+// environment. Err is set if the operation failed before any Secrets Engine could be addressed,
+// for example because the environment does not exist or Gafaspot was not able to get a vault
+// token. Otherwise, SecEngResults contains one entry for each Secrets Engine of the environment.
+// RollbackErr is set if undoing a partially started booking failed on environment level, e.g.
+// because the vault token could not be revoked.
+// TokenAccessor is the accessor of the orphan vault token which started the booking. RevokeErr is
+// set if revoking the token or leases failed when ending the booking.
+type BookingResult struct {
+	EnvPlainName  string
+	Err           error
+	SecEngResults []SecEngResult
+	RollbackErr   error
+	TokenAccessor string
+	RevokeErr     error
+}
+
+// BookingLeases bundles everything Vault issued for a booking which must be revoked at its end:
+// the accessor of the orphan vault token which started the booking and the ids of all leases
+// created with it, mapped by the names of the Secrets Engines which created them.
+type BookingLeases struct {
+	TokenAccessor string
+	LeaseIDs      map[string][]string
+}
+
+// Leases returns the token accessor and the lease ids of all Secrets Engines which hold the
+// booking.
+func (r BookingResult) Leases() BookingLeases {
+	leases := BookingLeases{TokenAccessor: r.TokenAccessor, LeaseIDs: make(map[string][]string)}
+	for _, s := range r.SecEngResults {
+		if s.holdsBooking() && len(s.LeaseIDs) > 0 {
+			leases.LeaseIDs[s.SecEngName] = s.LeaseIDs
+		}
+	}
+	return leases
+}
+
+// Succeeded returns true if the operation succeeded for all Secrets Engines of the environment.
+func (r BookingResult) Succeeded() bool {
+	if r.Err != nil || r.RevokeErr != nil {
+		return false
+	}
+	for _, s := range r.SecEngResults {
+		if !s.holdsBooking() {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns true if no Secrets Engine of the environment holds the booking, either because
+// the operation did not succeed anywhere or because it was rolled back completely. A
+// BookingResult which neither Succeeded nor Failed is a partial one.
+func (r BookingResult) Failed() bool {
+	if r.Err != nil {
+		return true
+	}
+	for _, s := range r.SecEngResults {
+		if s.holdsBooking() {
+			return false
+		}
+	}
+	return len(r.SecEngResults) > 0
+}
+
+// ErrorDetail assembles all errors of the BookingResult to one message which is suitable for
+// storing it in database or displaying it to the user. If the operation succeeded, the
+// result is an empty string.
+func (r BookingResult) ErrorDetail() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	var details []string
+	for _, s := range r.SecEngResults {
+		if s.Err != nil {
+			details = append(details, fmt.Sprintf("%v: %v", s.SecEngName, s.Err))
+		}
+		if s.RolledBack {
+			details = append(details, fmt.Sprintf("%v: rolled back", s.SecEngName))
+		}
+		if s.RollbackErr != nil {
+			details = append(details, fmt.Sprintf("%v: rollback failed: %v", s.SecEngName, s.RollbackErr))
+		}
+	}
+	if r.RollbackErr != nil {
+		details = append(details, fmt.Sprintf("rollback failed: %v", r.RollbackErr))
+	}
+	if r.RevokeErr != nil {
+		details = append(details, fmt.Sprintf("revocation failed: %v", r.RevokeErr))
+	}
+	return strings.Join(details, "; ")
+}
+
+// ReservationOutcome is a struct to store what happened to one reservation when Gafaspot tried
+// to start or end it. Action is one of the Action constants, Status is the reservation's status
+// afterwards. If anything went wrong, Problem describes it; otherwise it is empty.
+type ReservationOutcome struct {
+	Reservation Reservation
+	Action      string
+	Status      string
+	Problem     string
+}
+
+// Fail returns a copy of the ReservationOutcome with the given resulting status and problem.
+func (o ReservationOutcome) Fail(status, problem string) ReservationOutcome {
+	o.Status = status
+	o.Problem = problem
+	return o
+}
+
+// ScanReport is a struct to bundle the outcomes of all reservations handled within one
+// reservation scan.
+type ScanReport struct {
+	Time     time.Time
+	Outcomes []ReservationOutcome
+}
+
+// Problems returns only the outcomes of the ScanReport which describe a problem.
+func (r ScanReport) Problems() []ReservationOutcome {
+	problems := []ReservationOutcome{}
+	for _, o := range r.Outcomes {
+		if o.Problem != "" {
+			problems = append(problems, o)
+		}
+	}
+	return problems
+}
+
+// ReconciliationFinding describes one inconsistency between database and Vault, which was found
+// for an environment during a reconciliation.
+type ReconciliationFinding struct {
+	EnvPlainName string
+	// ReservationID is the id of the affected reservation, or 0 if there is none
+	ReservationID int
+	// Kind is one of the Finding constants
+	Kind   string
+	Detail string
+	// Resolved tells, whether Gafaspot could fix the inconsistency on its own
+	Resolved bool
+}
+
+// ReconciliationReport is a struct to bundle all findings of one reconciliation between
+// database and Vault.
+type ReconciliationReport struct {
+	Time time.Time
+	// Environments is the number of environments which were checked
+	Environments int
+	Findings     []ReconciliationFinding
+}
+
+// Unresolved returns only the findings of the ReconciliationReport which Gafaspot could not fix.
+func (r ReconciliationReport) Unresolved() []ReconciliationFinding {
+	unresolved := []ReconciliationFinding{}
+	for _, f := range r.Findings {
+		if !f.Resolved {
+			unresolved = append(unresolved, f)
+		}
+	}
+	return unresolved
+}
@@ -19,8 +19,10 @@
 package vault
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/AdvUni/gafaspot/util"
 )
@@ -28,6 +30,9 @@ import (
 const (
 	createEphemeralTokenPath = "auth/approle/login"
 	createOrphanTokenPath    = "auth/token/create-orphan"
+	revokeSelfTokenPath      = "auth/token/revoke-self"
+	revokeAccessorPath       = "auth/token/revoke-accessor"
+	renewAccessorPath        = "auth/token/renew-accessor"
 	ldapAuthBasicPath        = "auth/ldap/login"
 )
 
@@ -35,6 +40,9 @@ var (
 	ldapAuthBasicURL  string
 	ldapAuthPolicy    string
 	getOrphanTokenURL string
+	revokeTokenURL    string
+	revokeAccessorURL string
+	renewAccessorURL  string
 	apprl             approle
 )
 
@@ -55,6 +63,9 @@ func initAuth(c util.GafaspotConfig) {
 
 	// init orphan token
 	getOrphanTokenURL = joinRequestPath(c.VaultAddress, createOrphanTokenPath)
+	revokeTokenURL = joinRequestPath(c.VaultAddress, revokeSelfTokenPath)
+	revokeAccessorURL = joinRequestPath(c.VaultAddress, revokeAccessorPath)
+	renewAccessorURL = joinRequestPath(c.VaultAddress, renewAccessorPath)
 	tuneLeaseDuration(joinRequestPath(c.VaultAddress, "sys", "mounts", "auth", "token", "tune"), c.MaxBookingDays)
 
 	// init LDAP
@@ -67,27 +78,78 @@ func initAuth(c util.GafaspotConfig) {
 // ephemeral token to create an orphan token (orphan tokens do not get revoked
 // as soon as their parents expire). The orphan token can be created with an
 // individual life span, so they can be used to generate secrets leases at the
-// start of a reservation.
-func createOrphanVaultToken(ttl string) string {
-	payload := fmt.Sprintf("{\"ttl\": \"%s\"}", ttl)
-	token, err := sendVaultTokenRequest(getOrphanTokenURL, createEphemeralVaultToken(), strings.NewReader(payload))
+// start of a reservation. The token carries the given display name and metadata,
+// which show up in Vault's audit log. Besides the token, the function returns
+// the token's accessor, which allows to revoke the token later on.
+func createOrphanVaultToken(ttl, displayName string, meta map[string]string) (string, string, error) {
+	ephemeralToken, err := createEphemeralVaultToken()
 	if err != nil {
-		logger.Error(err)
+		return "", "", err
+	}
+	payload, err := json.Marshal(map[string]interface{}{"ttl": ttl, "display_name": displayName, "meta": meta})
+	if err != nil {
+		return "", "", fmt.Errorf("not able to marshal orphan token request: %v", err)
+	}
+	token, accessor, err := sendVaultTokenRequest(getOrphanTokenURL, ephemeralToken, strings.NewReader(string(payload)))
+	if err != nil {
+		return "", "", fmt.Errorf("not able to create orphan token: %v", err)
+	}
+	return token, accessor, nil
+}
+
+// revokeVaultToken revokes the given vault token. All leases created with the token get revoked
+// together with it. This is needed if a reservation's orphan token must die before its TTL ends.
+func revokeVaultToken(vaultToken string) error {
+	err := sendVaultRequestEmptyResponse("POST", revokeTokenURL, vaultToken, nil)
+	if err != nil {
+		return fmt.Errorf("not able to revoke token: %v", err)
+	}
+	return nil
+}
+
+// revokeVaultTokenAccessor revokes the vault token with the given accessor, together with all
+// leases created with the token. If the token does not exist anymore, e.g. because its TTL is
+// over, there is nothing to do.
+func revokeVaultTokenAccessor(vaultToken, accessor string) error {
+	payload := fmt.Sprintf("{\"accessor\": \"%s\"}", accessor)
+	err := sendVaultRequestEmptyResponse("POST", revokeAccessorURL, vaultToken, strings.NewReader(payload))
+	if err != nil && !strings.Contains(err.Error(), "invalid accessor") {
+		return fmt.Errorf("not able to revoke token by accessor: %v", err)
+	}
+	return nil
+}
+
+// renewVaultTokenAccessor renews the vault token with the given accessor, so it is valid for
+// increment from now on. If Vault grants a shorter duration, e.g. because of the max ttl of the
+// token auth method, an error is returned.
+func renewVaultTokenAccessor(vaultToken, accessor string, increment time.Duration) error {
+	payload := fmt.Sprintf("{\"accessor\": \"%s\", \"increment\": %d}", accessor, int(increment.Seconds()))
+	res, err := sendVaultRequest("POST", renewAccessorURL, vaultToken, strings.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("not able to renew token by accessor: %v", err)
+	}
+	auth, ok := res["auth"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("malformed json response from vault: Didn't find expected field 'auth'")
 	}
-	return token
+	err = checkRenewedDuration(auth["lease_duration"], increment)
+	if err != nil {
+		return fmt.Errorf("not able to renew token by accessor: %v", err)
+	}
+	return nil
 }
 
 // createEphemeralVaultToken performs an approle login to vault and returns the
 // received token. The token is only valid for a short time; this depends on
 // the approle role configuration in vault. Do not use this tokens for
 // generating secrets leases, as those leases would expire with the tokens.
-func createEphemeralVaultToken() string {
+func createEphemeralVaultToken() (string, error) {
 	payload := fmt.Sprintf("{\"role_id\": \"%v\", \"secret_id\": \"%v\"}", apprl.roleID, apprl.secretID)
-	token, err := sendVaultTokenRequest(apprl.getTokenURL, "", strings.NewReader(payload))
+	token, _, err := sendVaultTokenRequest(apprl.getTokenURL, "", strings.NewReader(payload))
 	if err != nil {
-		logger.Error(err)
+		return "", fmt.Errorf("not able to perform approle login: %v", err)
 	}
-	return token
+	return token, nil
 }
 
 // DoLdapAuthentication performs an LDAP authentication against a Vault LDAP Auth Method.
@@ -95,22 +157,27 @@ func createEphemeralVaultToken() string {
 // If so, it checks whether Vault assigns the ldap-group-policy given in gafaspot_config.yaml
 // to the login data. This is the case if the user is member of the correct LDAP group (and the
 // vault auth method is configured correctly).
-func DoLdapAuthentication(username, password string) bool {
+// Additionally, it returns all policies Vault assigned to the user. Gafaspot uses them as the
+// user's groups, e.g. for determining the user's booking quota.
+func DoLdapAuthentication(username, password string) ([]string, bool) {
 	url := ldapAuthBasicURL + "/" + username
 	payload := strings.NewReader(fmt.Sprintf("{\"password\": \"%v\"}", password))
 
 	availablePolicies, err := sendVaultLdapRequest(url, payload)
 	if err == ErrAuth {
-		return false
+		return nil, false
 	} else if err != nil {
 		logger.Error(err)
-		return false
+		return nil, false
 	}
 
+	policies := []string{}
+	authorized := false
 	for _, policy := range availablePolicies {
+		policies = append(policies, policy.(string))
 		if policy.(string) == ldapAuthPolicy {
-			return true
+			authorized = true
 		}
 	}
-	return false
+	return policies, authorized
 }
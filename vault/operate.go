@@ -20,6 +20,7 @@ package vault
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/AdvUni/gafaspot/util"
 )
@@ -37,13 +38,28 @@ const (
 // engine has an equivalently named kv secrets engine as storage which is also obtained by this interface.
 // A SecEng stores the URLs to which the secrets engines listen to and provides the functionality which
 // is needed to start and end bookings, as changing credentials and storing or deleting them.
+// startBooking returns the ids of all leases it created in Vault; extendBooking and endBooking get
+// them back to renew or revoke them.
 type SecEng interface {
 	getName() string
-	startBooking(vaultToken, sshKey string, ttl string)
-	endBooking(vaultToken string)
+	startBooking(vaultToken, sshKey string, ttl string) ([]string, error)
+	extendBooking(vaultToken, sshKey string, ttl string, leaseIDs []string) error
+	endBooking(vaultToken string, leaseIDs []string) error
 	readCreds(vaultToken string) (map[string]interface{}, error)
 }
 
+// sshSecEng is implemented by SecEngs which may issue credentials for a user's SSH key. If
+// usesSSHKey is true, they issue credentials for the keys of the co-users of a shared reservation
+// as well. Those get stored in kv storage below the owner's credentials, named after the co-user,
+// and endBooking deletes them together with the owner's ones.
+type sshSecEng interface {
+	SecEng
+	usesSSHKey() bool
+	startUserBooking(vaultToken, username, sshKey, ttl string) ([]string, error)
+	extendUserBooking(vaultToken, username, sshKey, ttl string) error
+	readUserCreds(vaultToken, username string) (map[string]interface{}, error)
+}
+
 // NewSecEng creates a new SecEng. From string engineType, it decides, which implementation of the interface
 // must be instanciated. The path snippets vaultAddress, env, name and role get assembled to the the
 // URLs, to which the vault secrets engines listen to.
@@ -61,7 +77,8 @@ func newSecEng(engineType, vaultAddress, env, name, role string, maxBookingDays
 		secEng.name = name
 		secEng.engineType = engineType
 		secEng.createLeaseURL = joinRequestPath(vaultAddress, wordOperate, env, name, wordCreds, role)
-		secEng.revokeLeaseURL = joinRequestPath(vaultAddress, "sys", "leases", "revoke-prefix", wordOperate, env, name, wordCreds, role)
+		secEng.renewLeaseURL = joinRequestPath(vaultAddress, "sys", "leases", "renew")
+		secEng.revokeLeaseURL = joinRequestPath(vaultAddress, "sys", "leases", "revoke")
 		secEng.storeDataURL = joinRequestPath(vaultAddress, wordStore, env, name, role, "data")
 
 		tuneLeaseDurationURL := joinRequestPath(vaultAddress, "sys", "mounts", wordOperate, env, name, "tune")
@@ -94,6 +111,8 @@ func initSecEngs(environmentConfigs map[string]util.EnvironmentConfig, vaultAddr
 				secretEngines = append(secretEngines, secretEngine)
 			}
 		}
+		// keep Secrets Engines sorted by name, so results of concurrent operations are always gathered in the same order
+		sort.Slice(secretEngines, func(i, j int) bool { return secretEngines[i].getName() < secretEngines[j].getName() })
 		environments[envPlainName] = secretEngines
 	}
 	return environments
@@ -20,6 +20,7 @@ package vault
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 // changepassSecEng is a SecEng implementation which works for Vault secrets engines listening to
@@ -38,29 +39,45 @@ func (secEng changepassSecEng) getName() string {
 
 // startBooking for a changepassSecEng means to change the credentials and store it inside the respective
 // kv secret engine inside Vault.
-func (secEng changepassSecEng) startBooking(vaultToken, _, _ string) {
-	data, err := json.Marshal(secEng.changeCreds(vaultToken))
+// Changing credentials does not create any leases.
+func (secEng changepassSecEng) startBooking(vaultToken, _, _ string) ([]string, error) {
+	creds, err := secEng.changeCreds(vaultToken)
 	if err != nil {
-		logger.Errorf("not able to marshal new creds: %v", err)
+		return nil, err
 	}
-	vaultStorageWrite(vaultToken, secEng.storeDataURL, data)
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return nil, fmt.Errorf("not able to marshal new creds: %v", err)
+	}
+	return nil, vaultStorageWrite(vaultToken, secEng.storeDataURL, data)
+}
+
+// extendBooking for a changepassSecEng does nothing. The stored credentials stay valid until they
+// get changed at the end of the booking, and changing them now would surprise the user.
+func (secEng changepassSecEng) extendBooking(_, _, _ string, _ []string) error {
+	return nil
 }
 
 // endBooking for a changepassSecEng means to delete the stored credentials from kv storage and then
-// change the credentials again for them to become unknown.
-func (secEng changepassSecEng) endBooking(vaultToken string) {
-	vaultStorageDelete(vaultToken, secEng.storeDataURL)
-	secEng.changeCreds(vaultToken)
+// change the credentials again for them to become unknown. The credentials get changed even if
+// deleting them from kv storage fails, as this is the part which actually locks out the user.
+func (secEng changepassSecEng) endBooking(vaultToken string, _ []string) error {
+	deleteErr := vaultStorageDelete(vaultToken, secEng.storeDataURL)
+	_, err := secEng.changeCreds(vaultToken)
+	if err != nil {
+		return err
+	}
+	return deleteErr
 }
 
 func (secEng changepassSecEng) readCreds(vaultToken string) (map[string]interface{}, error) {
 	return vaultStorageRead(vaultToken, secEng.storeDataURL)
 }
 
-func (secEng changepassSecEng) changeCreds(vaultToken string) map[string]interface{} {
+func (secEng changepassSecEng) changeCreds(vaultToken string) (map[string]interface{}, error) {
 	data, err := sendVaultDataRequest("GET", secEng.changeCredsURL, vaultToken, nil)
 	if err != nil {
-		logger.Errorf("not able to change Creds: %v", err)
+		return nil, fmt.Errorf("not able to change creds: %v", err)
 	}
-	return data
+	return data, nil
 }
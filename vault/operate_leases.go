@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/AdvUni/gafaspot/util"
 )
@@ -36,6 +37,7 @@ type leaseSecEng struct {
 	name                 string
 	engineType           string
 	createLeaseURL       string
+	renewLeaseURL        string
 	revokeLeaseURL       string
 	storeDataURL         string
 	tuneLeaseDurationURL string
@@ -47,51 +49,141 @@ func (secEng leaseSecEng) getName() string {
 
 // startBooking for a leaseSecEng means to create a lease in Vault and store the returned
 // credentials inside the respective kv secret engine. The ssh-pubkey secrets engine
-// uses the sshKey parameter, the database secrets engine not.
-func (secEng leaseSecEng) startBooking(vaultToken, sshKey, _ string) {
-	var data []byte
+// uses the sshKey parameter, the database secrets engine not. The lease's id is returned, so it
+// can be revoked explicitly at the end of the booking.
+func (secEng leaseSecEng) startBooking(vaultToken, sshKey, _ string) ([]string, error) {
+	var lease map[string]interface{}
+	var leaseID string
 	var err error
 
 	// perform different kinds of requests for database and ssh-pubkey secrets engines
 	if secEng.engineType == util.SecEngTypeSSHPubkey {
-		data, err = json.Marshal(secEng.createLeaseSSH(vaultToken, sshKey))
+		lease, leaseID, err = secEng.createLeaseSSH(vaultToken, sshKey)
 	} else {
-		data, err = json.Marshal(secEng.createLeaseDB(vaultToken))
+		lease, leaseID, err = secEng.createLeaseDB(vaultToken)
 	}
+	if err != nil {
+		return nil, err
+	}
+	leaseIDs := []string{leaseID}
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return leaseIDs, fmt.Errorf("not able to marshal new lease: %v", err)
+	}
+	return leaseIDs, vaultStorageWrite(vaultToken, secEng.storeDataURL, data)
+}
 
+// extendBooking for a leaseSecEng renews the leases with the given ids, so that they are valid
+// for ttl from now on. The credentials themselves stay the same.
+func (secEng leaseSecEng) extendBooking(vaultToken, _, ttl string, leaseIDs []string) error {
+	if len(leaseIDs) == 0 {
+		return fmt.Errorf("no lease ids known, so leases can not be renewed")
+	}
+	increment, err := time.ParseDuration(ttl)
 	if err != nil {
-		logger.Errorf("not able to marshal new lease: %v", err)
+		return fmt.Errorf("invalid ttl for renewing leases: %v", err)
+	}
+	for _, leaseID := range leaseIDs {
+		err := secEng.renewLease(vaultToken, leaseID, increment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewLease renews the Vault lease with id leaseID, so it is valid for increment from now on.
+// If Vault grants a shorter duration, e.g. because of the lease's max ttl, an error is returned.
+func (secEng leaseSecEng) renewLease(vaultToken, leaseID string, increment time.Duration) error {
+	payload := fmt.Sprintf("{\"lease_id\": \"%s\", \"increment\": %d}", leaseID, int(increment.Seconds()))
+	res, err := sendVaultRequest("PUT", secEng.renewLeaseURL, vaultToken, strings.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("not able to renew lease %v: %v", leaseID, err)
+	}
+	return checkRenewedDuration(res["lease_duration"], increment)
+}
+
+// endBooking for a leaseSecEng deletes the data from Vault's kv storage, including the one of
+// co-users, and revokes the leases with the given ids. The leases would also expire as soon as the token which created them gets
+// revoked, as they were created with an orphan token at reservation start, which TTL is set to
+// the reservation duration. Revoking them explicitly ends the booking right away, and it makes
+// the revocation visible in Vault's audit log. The leases are revoked even if deleting the data
+// from kv storage fails, as this is the part which actually locks out the user.
+func (secEng leaseSecEng) endBooking(vaultToken string, leaseIDs []string) error {
+	if secEng.usesSSHKey() {
+		vaultStorageDeleteBelow(vaultToken, secEng.storeDataURL)
 	}
-	vaultStorageWrite(vaultToken, secEng.storeDataURL, data)
+	deleteErr := vaultStorageDelete(vaultToken, secEng.storeDataURL)
+	for _, leaseID := range leaseIDs {
+		err := secEng.revokeLease(vaultToken, leaseID)
+		if err != nil {
+			return err
+		}
+	}
+	return deleteErr
 }
 
-// endBooking for a leaseSecEng only needs to delete the data from Vault's kv
-// storage, as vault leases expire automatically as soon as the token which
-// created the lease gets revoked. Therefore, the leases were created with an
-// orphan token at reservation start, which TTL is set to the reservation
-// duration.
-func (secEng leaseSecEng) endBooking(vaultToken string) {
-	vaultStorageDelete(vaultToken, secEng.storeDataURL)
+// revokeLease revokes the Vault lease with id leaseID. Revoking a lease which does not exist
+// anymore succeeds as well.
+func (secEng leaseSecEng) revokeLease(vaultToken, leaseID string) error {
+	payload := fmt.Sprintf("{\"lease_id\": \"%s\"}", leaseID)
+	err := sendVaultRequestEmptyResponse("PUT", secEng.revokeLeaseURL, vaultToken, strings.NewReader(payload))
+	if err != nil && !strings.Contains(err.Error(), "invalid lease") {
+		return fmt.Errorf("not able to revoke lease %v: %v", leaseID, err)
+	}
+	return nil
 }
 
 func (secEng leaseSecEng) readCreds(vaultToken string) (map[string]interface{}, error) {
 	return vaultStorageRead(vaultToken, secEng.storeDataURL)
 }
 
-func (secEng leaseSecEng) createLeaseDB(vaultToken string) map[string]interface{} {
-	data, err := sendVaultDataRequest("GET", secEng.createLeaseURL, vaultToken, nil)
+// usesSSHKey is true for the ssh-pubkey secrets engine only.
+func (secEng leaseSecEng) usesSSHKey() bool {
+	return secEng.engineType == util.SecEngTypeSSHPubkey
+}
+
+// startUserBooking creates a lease for the public key of a co-user and stores it for them. The
+// lease's id is returned, so it gets renewed and revoked together with the owner's lease.
+func (secEng leaseSecEng) startUserBooking(vaultToken, username, sshKey, _ string) ([]string, error) {
+	lease, leaseID, err := secEng.createLeaseSSH(vaultToken, sshKey)
+	if err != nil {
+		return nil, err
+	}
+	leaseIDs := []string{leaseID}
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return leaseIDs, fmt.Errorf("not able to marshal new lease: %v", err)
+	}
+	return leaseIDs, vaultStorageWrite(vaultToken, userStorageURL(secEng.storeDataURL, username), data)
+}
+
+// extendUserBooking has nothing to do, as the leases of co-users are renewed by extendBooking
+// together with the owner's lease.
+func (secEng leaseSecEng) extendUserBooking(_, _, _, _ string) error {
+	return nil
+}
+
+func (secEng leaseSecEng) readUserCreds(vaultToken, username string) (map[string]interface{}, error) {
+	return vaultStorageRead(vaultToken, userStorageURL(secEng.storeDataURL, username))
+}
+
+func (secEng leaseSecEng) createLeaseDB(vaultToken string) (map[string]interface{}, string, error) {
+	data, leaseID, err := sendVaultLeaseRequest("GET", secEng.createLeaseURL, vaultToken, nil)
 	if err != nil {
-		logger.Errorf("not able to create new lease: %v", err)
+		return nil, "", fmt.Errorf("not able to create new lease: %v", err)
 	}
-	return data
+	return data, leaseID, nil
 }
 
-func (secEng leaseSecEng) createLeaseSSH(vaultToken, sshKey string) map[string]interface{} {
+func (secEng leaseSecEng) createLeaseSSH(vaultToken, sshKey string) (map[string]interface{}, string, error) {
 	payload := fmt.Sprintf("{\"public_key\": \"%v\"}", sshKey)
 
-	data, err := sendVaultDataRequest("POST", secEng.createLeaseURL, vaultToken, strings.NewReader(payload))
+	data, leaseID, err := sendVaultLeaseRequest("POST", secEng.createLeaseURL, vaultToken, strings.NewReader(payload))
 	if err != nil {
-		logger.Errorf("not able to create new lease: %v", err)
+		return nil, "", fmt.Errorf("not able to create new lease: %v", err)
 	}
-	return data
+	return data, leaseID, nil
 }
@@ -37,16 +37,33 @@ type signedkeySecEng struct {
 
 // startBooking means for an ssh secret engine used with signed certificates to create an ssh signature for a given
 // public key. The signature is valid for a specified duration. As it should expire exactly with the booking's
-// expiration, the ttl in seconds is needed already at the booking's begin.
-func (secEng signedkeySecEng) startBooking(vaultToken, sshKey, ttl string) {
-	data, err := json.Marshal(secEng.signKey(vaultToken, sshKey, ttl))
+// expiration, the ttl in seconds is needed already at the booking's begin. Signatures are not
+// leases, so there are no lease ids to return.
+func (secEng signedkeySecEng) startBooking(vaultToken, sshKey, ttl string) ([]string, error) {
+	return nil, secEng.storeSignature(vaultToken, secEng.storeDataURL, sshKey, ttl)
+}
+
+// storeSignature signs the public key sshKey and writes the signature to kv storage at url.
+func (secEng signedkeySecEng) storeSignature(vaultToken, url, sshKey, ttl string) error {
+	signature, err := secEng.signKey(vaultToken, sshKey, ttl)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(signature)
 	if err != nil {
-		logger.Errorf("not able to marshal new signature: %v", err)
+		return fmt.Errorf("not able to marshal new signature: %v", err)
 	}
 	// remove the line feed from data, which is returned by the ssh secrets engine, as it corrupts the json
 	data = bytes.Replace(data, []byte("\n"), nil, -1)
 
-	vaultStorageWrite(vaultToken, secEng.storeDataURL, data)
+	return vaultStorageWrite(vaultToken, url, data)
+}
+
+// extendBooking signs the public key anew with the extended ttl and overwrites the stored
+// signature. The old signature stays valid until its original expiration.
+func (secEng signedkeySecEng) extendBooking(vaultToken, sshKey, ttl string, _ []string) error {
+	_, err := secEng.startBooking(vaultToken, sshKey, ttl)
+	return err
 }
 
 func (secEng signedkeySecEng) getName() string {
@@ -54,21 +71,42 @@ func (secEng signedkeySecEng) getName() string {
 }
 
 // endBooking only needs to delete the data from Vault's kv storage, as the signature expires at its own.
-func (secEng signedkeySecEng) endBooking(vaultToken string) {
-	vaultStorageDelete(vaultToken, secEng.storeDataURL)
+// This includes the signatures of co-users.
+func (secEng signedkeySecEng) endBooking(vaultToken string, _ []string) error {
+	vaultStorageDeleteBelow(vaultToken, secEng.storeDataURL)
+	return vaultStorageDelete(vaultToken, secEng.storeDataURL)
 }
 
 func (secEng signedkeySecEng) readCreds(vaultToken string) (map[string]interface{}, error) {
 	return vaultStorageRead(vaultToken, secEng.storeDataURL)
 }
 
-func (secEng signedkeySecEng) signKey(vaultToken, sshKey, ttl string) map[string]interface{} {
+func (secEng signedkeySecEng) usesSSHKey() bool {
+	return true
+}
+
+// startUserBooking signs the public key of a co-user and stores the signature for them.
+func (secEng signedkeySecEng) startUserBooking(vaultToken, username, sshKey, ttl string) ([]string, error) {
+	return nil, secEng.storeSignature(vaultToken, userStorageURL(secEng.storeDataURL, username), sshKey, ttl)
+}
+
+// extendUserBooking signs the public key of a co-user anew with the extended ttl.
+func (secEng signedkeySecEng) extendUserBooking(vaultToken, username, sshKey, ttl string) error {
+	_, err := secEng.startUserBooking(vaultToken, username, sshKey, ttl)
+	return err
+}
+
+func (secEng signedkeySecEng) readUserCreds(vaultToken, username string) (map[string]interface{}, error) {
+	return vaultStorageRead(vaultToken, userStorageURL(secEng.storeDataURL, username))
+}
+
+func (secEng signedkeySecEng) signKey(vaultToken, sshKey, ttl string) (map[string]interface{}, error) {
 
 	payload := fmt.Sprintf("{\"public_key\": \"%s\", \"ttl\": \"%s\"}", sshKey, ttl)
 
 	data, err := sendVaultDataRequest("POST", secEng.signURL, vaultToken, strings.NewReader(payload))
 	if err != nil {
-		logger.Errorf("not able to sign key: %v", err)
+		return nil, fmt.Errorf("not able to sign key: %v", err)
 	}
-	return data
+	return data, nil
 }
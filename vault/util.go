@@ -28,11 +28,16 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 // ErrAuth is thrown if an authentication against LDAP over Vault fails for any reason.
 var ErrAuth = errors.New("ldap authentication failed")
 
+// errNotFound is returned by sendVaultRequest if Vault answers with status code 404, e.g. when
+// reading from a KV Secrets Engine which does not store anything at the requested path.
+var errNotFound = errors.New("vault API returned 404 not found")
+
 func sendVaultDataRequest(requestType, url, vaultToken string, body io.Reader) (map[string]interface{}, error) {
 	res, err := sendVaultRequest(requestType, url, vaultToken, body)
 	if err != nil {
@@ -50,26 +55,57 @@ func sendVaultDataRequest(requestType, url, vaultToken string, body io.Reader) (
 	return data.(map[string]interface{}), nil
 }
 
-func sendVaultTokenRequest(url, vaultToken string, body io.Reader) (string, error) {
+// sendVaultLeaseRequest works like sendVaultDataRequest, but additionally returns the id of the
+// lease Vault created for the returned data.
+func sendVaultLeaseRequest(requestType, url, vaultToken string, body io.Reader) (map[string]interface{}, string, error) {
+	res, err := sendVaultRequest(requestType, url, vaultToken, body)
+	if err != nil {
+		return nil, "", err
+	}
+	data, ok := res["data"]
+	if !ok {
+		err = fmt.Errorf("malformed json response from vault: Didn't find expected field 'data'")
+		return nil, "", err
+	}
+	if data == "null" {
+		err = fmt.Errorf("json response from vault not has expected content: Tried to fetch field 'data', but it seems to be empty")
+		return nil, "", err
+	}
+	leaseID, ok := res["lease_id"].(string)
+	if !ok {
+		err = fmt.Errorf("malformed json response from vault: Didn't find expected field 'lease_id'")
+		return nil, "", err
+	}
+	return data.(map[string]interface{}), leaseID, nil
+}
+
+// sendVaultTokenRequest sends a request which creates a vault token and returns the token
+// together with its accessor.
+func sendVaultTokenRequest(url, vaultToken string, body io.Reader) (string, string, error) {
 	res, err := sendVaultRequest("POST", url, vaultToken, body)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	authField, ok := res["auth"]
 	if !ok {
 		err = fmt.Errorf("malformed json response from vault: Didn't find expected field 'auth'")
-		return "", err
+		return "", "", err
 	}
 	if authField == "null" {
 		err = fmt.Errorf("json response from vault not has expected content: Tried to fetch field 'auth', but it seems to be empty")
-		return "", err
+		return "", "", err
 	}
 	token, ok := authField.(map[string]interface{})["client_token"]
 	if !ok {
 		err = fmt.Errorf("malformed json response from vault: Didn't find expected field 'client_token' inside 'auth'")
-		return "", err
+		return "", "", err
+	}
+	accessor, ok := authField.(map[string]interface{})["accessor"]
+	if !ok {
+		err = fmt.Errorf("malformed json response from vault: Didn't find expected field 'accessor' inside 'auth'")
+		return "", "", err
 	}
-	return token.(string), nil
+	return token.(string), accessor.(string), nil
 
 }
 
@@ -160,6 +196,8 @@ func sendVaultRequest(requestType, url, vaultToken string, body io.Reader) (map[
 		return result, nil
 	case "204 No Content":
 		return nil, nil
+	case "404 Not Found":
+		return nil, errNotFound
 	default:
 		jsonErrors := result["errors"]
 		err = fmt.Errorf("vault API returned following error(s): %v", jsonErrors)
@@ -167,6 +205,21 @@ func sendVaultRequest(requestType, url, vaultToken string, body io.Reader) (map[
 	}
 }
 
+// checkRenewedDuration checks whether the lease duration Vault returned after renewing a token or
+// lease covers the requested increment. A tolerance of one minute accounts for the time passing
+// during the request.
+func checkRenewedDuration(leaseDuration interface{}, increment time.Duration) error {
+	seconds, ok := leaseDuration.(float64)
+	if !ok {
+		return fmt.Errorf("malformed json response from vault: Didn't find expected field 'lease_duration'")
+	}
+	granted := time.Duration(seconds) * time.Second
+	if granted < increment-time.Minute {
+		return fmt.Errorf("vault only granted a duration of %v instead of %v", granted, increment.Round(time.Second))
+	}
+	return nil
+}
+
 func joinRequestPath(addressStart string, subpaths ...string) string {
 	url, err := url.Parse(addressStart)
 	if err != nil {
@@ -183,8 +236,12 @@ func joinRequestPath(addressStart string, subpaths ...string) string {
 func tuneLeaseDuration(tuneLeaseDurationURL string, maxBookingDays int) {
 	hours := maxBookingDays * 24
 	payload := fmt.Sprintf("{\"default_lease_ttl\": \"%vh\", \"max_lease_ttl\": \"%vh\"}", hours, hours)
-	vaultToken := createEphemeralVaultToken()
-	err := sendVaultRequestEmptyResponse("POST", tuneLeaseDurationURL, vaultToken, strings.NewReader(payload))
+	vaultToken, err := createEphemeralVaultToken()
+	if err != nil {
+		logger.Errorf("not able to tune lease duration: %v", err)
+		return
+	}
+	err = sendVaultRequestEmptyResponse("POST", tuneLeaseDurationURL, vaultToken, strings.NewReader(payload))
 	if err != nil {
 		logger.Errorf("not able to tune lease duration: %v", err)
 	}
@@ -19,6 +19,10 @@
 package vault
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/AdvUni/gafaspot/util"
@@ -28,6 +32,8 @@ import (
 var (
 	logger       logging.Logger
 	environments map[string][]SecEng
+	// maxParallel limits the number of Secrets Engines of one environment which are addressed at the same time
+	maxParallel int
 )
 
 // InitVaultParams initializes the vault package from gafaspot. Besides setting the logger, it
@@ -37,70 +43,319 @@ var (
 func InitVaultParams(l logging.Logger, config util.GafaspotConfig) {
 
 	logger = l
+	maxParallel = config.MaxParallel
 
 	initAuth(config)
 	environments = initSecEngs(config.Environments, config.VaultAddress, config.MaxBookingDays)
 }
 
-// StartBooking starts a booking for a whole environment. As the environment may include ssh secret
-// engines, this function needs an ssh key. If there is no ssh secret engine inside
-// the environment, the ssKey parameter will be ignored everywhere.
-// The time 'until' is needed to calculate the ttl for an orphan vault token, which will be parent
-// of all the vault secrets in this reservation.
-func StartBooking(envPlainName, sshKey string, until time.Time) {
-	ttl := until.Sub(time.Now()).String()
+// StartBooking starts a booking for the environment of the reservation r. As the environment may
+// include ssh secret engines, this function needs an ssh key. If there is no ssh secret engine
+// inside the environment, the ssKey parameter will be ignored everywhere.
+// The reservation's end is needed to calculate the ttl for an orphan vault token, which will be
+// parent of all the vault secrets in this reservation. The token carries the reservation's id,
+// user and environment as metadata, so Vault's audit log can be tied back to the reservation.
+// The returned BookingResult contains the token's accessor and the ids of all created leases, so
+// they can be revoked explicitly at the end of the booking.
+// The Secrets Engines are started concurrently, limited by max-parallel-operations from config.
+// Secrets Engines which use SSH keys issue credentials for the co-users of a shared reservation as
+// well; coUserKeys maps their names to their keys.
+// The returned BookingResult tells for each Secrets Engine, whether it could be started. If
+// there is no vault token available, no Secrets Engine is addressed at all. If starting fails
+// for some of the Secrets Engines, the booking gets rolled back for all others.
+func StartBooking(r util.Reservation, sshKey string, coUserKeys map[string]string) util.BookingResult {
+	envPlainName := r.EnvPlainName
+	result := util.BookingResult{EnvPlainName: envPlainName}
+	ttl := r.End.Sub(time.Now()).String()
 	environment, ok := environments[envPlainName]
 	if !ok {
-		logger.Errorf("tried to start booking for environment '%v' but it does not exist", envPlainName)
-		return
+		result.Err = fmt.Errorf("tried to start booking for environment '%v' but it does not exist", envPlainName)
+		logger.Error(result.Err)
+		return result
 	}
 	// use an orphan token here, as some Secrets Engines create leases which
 	// get revoked as soon as the creating token expires. The orphan token
 	// lives as long as the reservation is valid, so, leases created by the
 	// token will be revoked automatically at reservation end.
-	vaultToken := createOrphanVaultToken(ttl)
-	for _, secEng := range environment {
-		secEng.startBooking(vaultToken, sshKey, ttl)
+	displayName := fmt.Sprintf("gafaspot-reservation-%v", r.ID)
+	meta := map[string]string{
+		"reservation_id": strconv.Itoa(r.ID),
+		"user":           r.User,
+		"environment":    envPlainName,
 	}
+	vaultToken, accessor, err := createOrphanVaultToken(ttl, displayName, meta)
+	if err != nil {
+		result.Err = err
+		logger.Errorf("not able to start booking for environment '%v': %v", envPlainName, err)
+		return result
+	}
+	result.TokenAccessor = accessor
+	result.SecEngResults = make([]util.SecEngResult, len(environment))
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		secEng := environment[i]
+		leaseIDs, err := secEng.startBooking(vaultToken, sshKey, ttl)
+		if err == nil {
+			var userLeaseIDs []string
+			userLeaseIDs, err = startUserBookings(secEng, vaultToken, coUserKeys, ttl)
+			leaseIDs = append(leaseIDs, userLeaseIDs...)
+			// the Secrets Engine counts as not started now, so rollbackBooking won't end it
+			if err != nil {
+				if endErr := secEng.endBooking(vaultToken, leaseIDs); endErr != nil {
+					logger.Errorf("failed to end booking for Secrets Engine '%v' in environment '%v': %v", secEng.getName(), envPlainName, endErr)
+				}
+			}
+		}
+		if err != nil {
+			logger.Errorf("failed to start booking for Secrets Engine '%v' in environment '%v': %v", secEng.getName(), envPlainName, err)
+		}
+		result.SecEngResults[i] = util.SecEngResult{SecEngName: secEng.getName(), Err: err, LeaseIDs: leaseIDs}
+	})
+
+	// an environment must never stay half-reserved, so undo everything if any Secrets Engine failed
+	if !result.Succeeded() {
+		rollbackBooking(environment, vaultToken, &result)
+	}
+	return result
+}
+
+// startUserBookings issues credentials for the co-users in coUserKeys, if secEng uses SSH keys at
+// all. It returns the ids of all leases it created, also if it fails for some co-user.
+func startUserBookings(secEng SecEng, vaultToken string, coUserKeys map[string]string, ttl string) ([]string, error) {
+	sshEng, ok := secEng.(sshSecEng)
+	if !ok || !sshEng.usesSSHKey() {
+		return nil, nil
+	}
+	var leaseIDs []string
+	for _, username := range sortedUsernames(coUserKeys) {
+		ids, err := sshEng.startUserBooking(vaultToken, username, coUserKeys[username], ttl)
+		leaseIDs = append(leaseIDs, ids...)
+		if err != nil {
+			return leaseIDs, fmt.Errorf("not able to issue credentials for co-user '%v': %v", username, err)
+		}
+	}
+	return leaseIDs, nil
+}
+
+// extendUserBookings extends the credentials of the co-users in coUserKeys, if secEng uses SSH
+// keys at all.
+func extendUserBookings(secEng SecEng, vaultToken string, coUserKeys map[string]string, ttl string) error {
+	sshEng, ok := secEng.(sshSecEng)
+	if !ok || !sshEng.usesSSHKey() {
+		return nil
+	}
+	for _, username := range sortedUsernames(coUserKeys) {
+		err := sshEng.extendUserBooking(vaultToken, username, coUserKeys[username], ttl)
+		if err != nil {
+			return fmt.Errorf("not able to extend credentials for co-user '%v': %v", username, err)
+		}
+	}
+	return nil
+}
+
+func sortedUsernames(coUserKeys map[string]string) []string {
+	usernames := make([]string, 0, len(coUserKeys))
+	for username := range coUserKeys {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// rollbackBooking undoes a booking start which did not succeed for all Secrets Engines of an
+// environment. It ends the booking for every Secrets Engine which was started successfully, which
+// deletes their credentials from kv storage, and then revokes the orphan vault token, which
+// revokes all leases created at the booking start. The outcome gets recorded inside result.
+func rollbackBooking(environment []SecEng, vaultToken string, result *util.BookingResult) {
+	logger.Warningf("rolling back booking start for environment '%v'", result.EnvPlainName)
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		if result.SecEngResults[i].Err != nil {
+			return
+		}
+		secEng := environment[i]
+		err := secEng.endBooking(vaultToken, result.SecEngResults[i].LeaseIDs)
+		if err != nil {
+			logger.Errorf("failed to roll back booking for Secrets Engine '%v' in environment '%v': %v", secEng.getName(), result.EnvPlainName, err)
+			result.SecEngResults[i].RollbackErr = err
+		} else {
+			result.SecEngResults[i].RolledBack = true
+		}
+	})
+	err := revokeVaultToken(vaultToken)
+	if err != nil {
+		logger.Errorf("failed to revoke vault token while rolling back booking for environment '%v': %v", result.EnvPlainName, err)
+		result.RollbackErr = err
+	}
+}
+
+// EndBooking ends a booking for a whole environment. The Secrets Engines are ended concurrently,
+// limited by max-parallel-operations from config. The leases and the orphan vault token in leases
+// get revoked explicitly; leases may be empty, e.g. for bookings started by older Gafaspot
+// versions. The returned BookingResult tells for each Secrets Engine, whether it could be ended.
+func EndBooking(envPlainName string, leases util.BookingLeases) util.BookingResult {
+	result := util.BookingResult{EnvPlainName: envPlainName}
+	environment, ok := environments[envPlainName]
+	if !ok {
+		result.Err = fmt.Errorf("tried to end booking for environment '%v' but it does not exist", envPlainName)
+		logger.Error(result.Err)
+		return result
+	}
+	vaultToken, err := createEphemeralVaultToken()
+	if err != nil {
+		result.Err = err
+		logger.Errorf("not able to end booking for environment '%v': %v", envPlainName, err)
+		return result
+	}
+	result.SecEngResults = make([]util.SecEngResult, len(environment))
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		secEng := environment[i]
+		err := secEng.endBooking(vaultToken, leases.LeaseIDs[secEng.getName()])
+		if err != nil {
+			logger.Errorf("failed to end booking for Secrets Engine '%v' in environment '%v': %v", secEng.getName(), envPlainName, err)
+		}
+		result.SecEngResults[i] = util.SecEngResult{SecEngName: secEng.getName(), Err: err}
+	})
+
+	// revoke the orphan token which started the booking, together with all leases left
+	if leases.TokenAccessor != "" {
+		err := revokeVaultTokenAccessor(vaultToken, leases.TokenAccessor)
+		if err != nil {
+			logger.Errorf("failed to end booking for environment '%v': %v", envPlainName, err)
+			result.RevokeErr = err
+		}
+	}
+	return result
 }
 
-// EndBooking ends a booking for a whole environment.
-func EndBooking(envPlainName string) {
-	vaultToken := createEphemeralVaultToken()
+// ExtendBooking extends the booking for the environment of the active reservation r until the
+// reservation's end. It renews the orphan vault token which started the booking and all leases
+// created with it, and it signs SSH keys anew, also the ones of the co-users in coUserKeys.
+// Passwords are not changed. If the token can not be
+// renewed, no Secrets Engine is addressed at all and the returned BookingResult's Err is set.
+// Otherwise, it tells for each Secrets Engine whether it could be extended.
+func ExtendBooking(r util.Reservation, sshKey string, coUserKeys map[string]string, leases util.BookingLeases) util.BookingResult {
+	envPlainName := r.EnvPlainName
+	result := util.BookingResult{EnvPlainName: envPlainName, TokenAccessor: leases.TokenAccessor}
+	increment := time.Until(r.End)
 	environment, ok := environments[envPlainName]
 	if !ok {
-		logger.Errorf("tried to end booking for environment '%v' but it does not exist", envPlainName)
-		return
+		result.Err = fmt.Errorf("tried to extend booking for environment '%v' but it does not exist", envPlainName)
+		logger.Error(result.Err)
+		return result
 	}
-	for _, secEng := range environment {
-		secEng.endBooking(vaultToken)
+	if leases.TokenAccessor == "" {
+		result.Err = fmt.Errorf("the booking for environment '%v' was started without storing its vault token, so it can not be extended", envPlainName)
+		logger.Error(result.Err)
+		return result
+	}
+
+	vaultToken, err := createEphemeralVaultToken()
+	if err != nil {
+		result.Err = err
+		logger.Errorf("not able to extend booking for environment '%v': %v", envPlainName, err)
+		return result
 	}
+	// without renewing the token, all leases would die with it at the old end
+	err = renewVaultTokenAccessor(vaultToken, leases.TokenAccessor, increment)
+	if err != nil {
+		result.Err = err
+		logger.Errorf("not able to extend booking for environment '%v': %v", envPlainName, err)
+		return result
+	}
+
+	ttl := increment.String()
+	result.SecEngResults = make([]util.SecEngResult, len(environment))
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		secEng := environment[i]
+		err := secEng.extendBooking(vaultToken, sshKey, ttl, leases.LeaseIDs[secEng.getName()])
+		if err == nil {
+			err = extendUserBookings(secEng, vaultToken, coUserKeys, ttl)
+		}
+		if err != nil {
+			logger.Errorf("failed to extend booking for Secrets Engine '%v' in environment '%v': %v", secEng.getName(), envPlainName, err)
+		}
+		result.SecEngResults[i] = util.SecEngResult{SecEngName: secEng.getName(), Err: err}
+	})
+	return result
 }
 
 // ReadCredentials reads the credentials from all KV Secrets Engine related to the environment
 // envPlainName and returns them as map. Map keys are the Secrets Engine's names. If it is not
-// possible to retrieve any credentials because the environment does not exist, an error message
-// gets logged and the result is nil. If retrieving of credentials fails for a specific
+// possible to retrieve any credentials because the environment does not exist or there is no
+// vault token available, an error message gets logged and the result is nil. If retrieving of credentials fails for a specific
 // Secrets Engine, a small error message gets written into the map instead of the credentials, so
-// that it will be automatically displayed in the creds view.
-func ReadCredentials(envPlainName string) map[string]map[string]interface{} {
+// that it will be automatically displayed in the creds view. The Secrets Engines are read
+// concurrently, limited by max-parallel-operations from config.
+// If coUser is not empty, the credentials are read for this co-user of a shared reservation: Secrets
+// Engines which use SSH keys provide the credentials issued for the co-user's key then.
+func ReadCredentials(envPlainName, coUser string) map[string]map[string]interface{} {
 	environment, ok := environments[envPlainName]
 	if !ok {
 		logger.Warningf("tried to read creds for environment '%v' which does not exist", envPlainName)
 		return nil
 	}
 
-	vaultToken := createEphemeralVaultToken()
+	vaultToken, err := createEphemeralVaultToken()
+	if err != nil {
+		logger.Errorf("not able to read creds for environment '%v': %v", envPlainName, err)
+		return nil
+	}
 
-	credentials := make(map[string]map[string]interface{})
-	for _, secEng := range environment {
-		c, err := secEng.readCreds(vaultToken)
+	creds := make([]map[string]interface{}, len(environment))
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		secEng := environment[i]
+		var c map[string]interface{}
+		var err error
+		if sshEng, ok := secEng.(sshSecEng); ok && coUser != "" && sshEng.usesSSHKey() {
+			c, err = sshEng.readUserCreds(vaultToken, coUser)
+		} else {
+			c, err = secEng.readCreds(vaultToken)
+		}
 		if err != nil {
 			logger.Warningf("failed to read creds from Secrets Engine '%v' in environment '%v': %v", secEng.getName(), envPlainName, err)
-			credentials[secEng.getName()] = map[string]interface{}{"error": "not possible to provide credentials"}
-		} else {
-			credentials[secEng.getName()] = c
+			c = map[string]interface{}{"error": "not possible to provide credentials"}
 		}
+		creds[i] = c
+	})
+
+	credentials := make(map[string]map[string]interface{})
+	for i, secEng := range environment {
+		credentials[secEng.getName()] = creds[i]
 	}
 	return credentials
 }
+
+// InspectStoredCredentials checks for each Secrets Engine of the environment envPlainName,
+// whether there are credentials stored in its KV Secrets Engine. The result maps the Secrets
+// Engine's names to the outcome. If any Secrets Engine can not be inspected, an error is returned
+// instead, as it is not possible to tell the environment's state then.
+func InspectStoredCredentials(envPlainName string) (map[string]bool, error) {
+	environment, ok := environments[envPlainName]
+	if !ok {
+		return nil, fmt.Errorf("tried to inspect environment '%v' but it does not exist", envPlainName)
+	}
+
+	vaultToken, err := createEphemeralVaultToken()
+	if err != nil {
+		return nil, fmt.Errorf("not able to inspect environment '%v': %v", envPlainName, err)
+	}
+
+	stored := make([]bool, len(environment))
+	errs := make([]error, len(environment))
+	util.RunParallel(len(environment), maxParallel, func(i int) {
+		_, err := environment[i].readCreds(vaultToken)
+		if err == nil {
+			stored[i] = true
+		} else if !errors.Is(err, errNotFound) {
+			errs[i] = fmt.Errorf("not able to inspect Secrets Engine '%v' in environment '%v': %v", environment[i].getName(), envPlainName, err)
+		}
+	})
+
+	result := make(map[string]bool)
+	for i, secEng := range environment {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		result[secEng.getName()] = stored[i]
+	}
+	return result, nil
+}
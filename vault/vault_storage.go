@@ -20,23 +20,67 @@ package vault
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 )
 
-func vaultStorageWrite(vaultToken, url string, data []byte) {
-
+func vaultStorageWrite(vaultToken, url string, data []byte) error {
 	err := sendVaultRequestEmptyResponse("POST", url, vaultToken, bytes.NewReader(data))
 	if err != nil {
-		logger.Errorf("failed to write to KV Secrets Engine: %v", err)
+		return fmt.Errorf("failed to write to KV Secrets Engine: %v", err)
 	}
+	return nil
 }
 
 func vaultStorageRead(vaultToken, url string) (map[string]interface{}, error) {
 	return sendVaultDataRequest("GET", url, vaultToken, nil)
 }
 
-func vaultStorageDelete(vaultToken, url string) {
+func vaultStorageDelete(vaultToken, url string) error {
 	err := sendVaultRequestEmptyResponse("DELETE", url, vaultToken, nil)
 	if err != nil {
-		logger.Warningf("failed to delete from KV Secrets Engine: %v", err)
+		return fmt.Errorf("failed to delete from KV Secrets Engine: %v", err)
+	}
+	return nil
+}
+
+// userStorageURL returns the URL at which the credentials of user username get stored below the
+// kv storage path storeDataURL.
+func userStorageURL(storeDataURL, username string) string {
+	return storeDataURL + "/" + url.PathEscape(username)
+}
+
+// vaultStorageDeleteBelow deletes all entries which are stored directly below the path url in kv
+// storage, but not the entry at url itself. If there are none, there is nothing to do.
+// Gafaspot stores the credentials of co-users there. As they become invalid at the booking's end
+// anyway, a failure only gets logged, e.g. if Gafaspot's policy does not allow listing yet.
+func vaultStorageDeleteBelow(vaultToken, url string) {
+	err := deleteBelow(vaultToken, url)
+	if err != nil {
+		logger.Warningf("not able to delete credentials of co-users below %v: %v", url, err)
+	}
+}
+
+func deleteBelow(vaultToken, url string) error {
+	data, err := sendVaultDataRequest("LIST", url, vaultToken, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list KV Secrets Engine: %v", err)
+	}
+	keys, _ := data["keys"].([]interface{})
+	for _, k := range keys {
+		key, _ := k.(string)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		err = vaultStorageDelete(vaultToken, userStorageURL(url, key))
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }